@@ -1,11 +1,21 @@
 package viamchess
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,13 +26,17 @@ import (
 
 	"github.com/mitchellh/mapstructure"
 
+	datasyncpb "go.viam.com/api/app/datasync/v1"
+
 	"go.viam.com/rdk/components/arm"
 	"go.viam.com/rdk/components/gripper"
 	"go.viam.com/rdk/components/switch"
 	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/pointcloud"
 	"go.viam.com/rdk/referenceframe"
 	"go.viam.com/rdk/resource"
 	"go.viam.com/rdk/robot/framesystem"
+	"go.viam.com/rdk/services/datamanager"
 	generic "go.viam.com/rdk/services/generic"
 	"go.viam.com/rdk/services/motion"
 	"go.viam.com/rdk/services/vision"
@@ -39,7 +53,7 @@ import (
 
 var ChessModel = family.WithModel("chess")
 
-const safeZ = 200.0
+const defaultSafeZ = 200.0
 
 func init() {
 	resource.RegisterService(generic.API, ChessModel,
@@ -55,10 +69,181 @@ type ChessConfig struct {
 	Arm     string
 	Gripper string
 
-	PoseStart string `json:"pose-start"`
+	PoseStart     string `json:"pose-start"`
+	StartPosition *int   `json:"start-position"` // switch position of pose-start that is the start pose, default 2
+	SettleMs      int    `json:"settle-ms"`      // wait after going to the start pose before reading where the gripper is, default 1000
 
 	Engine       string
-	EngineMillis int `json:"engine-millis"`
+	NoEngine     bool `json:"no-engine"` // don't start an engine, the robot plays the first legal move; for bring-up without stockfish
+	EngineMillis int  `json:"engine-millis"`
+	EngineDepth  int  `json:"engine-depth"`
+
+	SkillLevel       *int `json:"skill-level"`        // 0-20, lower is weaker
+	UCILimitStrength bool `json:"uci-limit-strength"` // if set, the engine plays at uci-elo
+	UCIElo           int  `json:"uci-elo"`
+
+	BlunderRate float64 `json:"blunder-rate"` // 0-1, how often to play a worse move on purpose, for beginners
+
+	ResignThresholdCp int `json:"resign-threshold-cp"` // resign when the engine thinks the robot is this far behind, 0 never resigns
+
+	TimeControl *TimeControl `json:"time-control"` // if set, games are timed and the engine thinks based on its clock
+
+	OpeningBook string `json:"opening-book"` // path to a polyglot .bin book, tried before the engine
+
+	RobotColor string `json:"robot-color"` // "white" or "black", empty plays whichever side is to move
+
+	AlternateColors bool `json:"alternate-colors"` // swap robot-color every new_game, like a match
+
+	VerifySetup bool `json:"verify-setup"` // check the board is set up before the first move
+	VerifyBoard bool `json:"verify-board"` // check the camera agrees with the game before every robot move
+
+	VerifyPlacement bool `json:"verify-placement"` // look again after every robot move to check the piece landed
+
+	KnockoverRecovery bool    `json:"knockover-recovery"`
+	LowGrabZ          float64 `json:"low-grab-z"`      // how low to grab a piece lying on its side
+	UprightPlaceZ     float64 `json:"upright-place-z"` // where to let go of a piece being stood back up, default 60
+
+	SafeZ        float64 `json:"safe-z"`         // height to travel at, above the tallest piece
+	CaptureDropZ float64 `json:"capture-drop-z"` // height to let go of captured pieces, defaults to the height they were grabbed at
+
+	// a missed grab is retried grab-step lower each time, down to grab-min-z
+	GrabStep float64 `json:"grab-step"`
+	GrabMinZ float64 `json:"grab-min-z"` // too low and the gripper hits the board
+
+	// in whatever units the arm's move_gripper and get_gripper commands use
+	GripperOpenWidth float64 `json:"gripper-open-width"`
+	GrabMinWidth     float64 `json:"grab-min-width"` // a closed gripper narrower than this is holding nothing
+
+	// how the gripper approaches a square, for arms mounted somewhere else
+	GripperThetaOffset float64  `json:"gripper-theta-offset"` // degrees, added to the theta of the start pose
+	TiltXStart         *float64 `json:"tilt-x-start"`         // past this X the gripper tilts away from straight down, default 300
+	TiltX              *float64 `json:"tilt-x"`               // OX per mm past tilt-x-start, default 0.001, 0 never tilts
+
+	// arm joint speed in degrees per second, set with the arm's set_speed command; 0 leaves the arm's own setting
+	TravelSpeed float64 `json:"travel-speed"` // moving between squares at safe-z
+	PlaceSpeed  float64 `json:"place-speed"`  // going down to grab or place a piece, slower knocks over fewer pieces
+
+	RandomSeed int64 `json:"random-seed"` // if set, book and random move choices are reproducible
+
+	// if BoardA1 and SquareSize are set, square centers are computed rather than found with vision
+	BoardA1    *r3.Vector `json:"board-a1"`    // outside corner of a1 in world coordinates
+	SquareSize float64    `json:"square-size"` // mm
+	BoardAngle float64    `json:"board-angle"` // degrees from world +X to the a->h direction
+	BoardZ     float64    `json:"board-z"`     // used when vision can't give a height
+
+	// mm wide box around the middle of a square to look for the top of its piece in, default square-size,
+	// so the side of a taller neighbor in the square's image box isn't taken for the top; with neither it's
+	// as wide as the board showing in the square's points
+	HighRegion float64 `json:"high-region"`
+
+	SettleCaptures int `json:"settle-captures"` // identical captures needed before accepting a human move
+
+	DataManager string   `json:"data-manager"` // if set, every grab is uploaded to these datasets
+	DatasetIDs  []string `json:"dataset-ids"`
+
+	// if set, every robot move is published here, for spectators
+	MQTTBroker   string `json:"mqtt-broker"` // host:port, ssl://host:port for TLS
+	MQTTTopic    string `json:"mqtt-topic"`
+	MQTTUsername string `json:"mqtt-username"`
+	MQTTPassword string `json:"mqtt-password"`
+	WebhookURL   string `json:"webhook-url"` // POSTed the same JSON as mqtt
+
+	Speech string `json:"speech"` // optional, a service whose DoCommand takes {"say": "..."} to announce moves
+
+	TurnIndicator string `json:"turn-indicator"` // optional switch, position 1 while it's the robot's turn, 0 while waiting for a person
+
+	// for playing a lichess bot account's games on the real board
+	LichessToken  string `json:"lichess-token"`
+	LichessGameID string `json:"lichess-game-id"` // default game for the lichess command
+
+	StartupRetries int `json:"startup-retries"` // warm-up captures to try while the piece-finder starts
+
+	MoveTimeoutSec int `json:"move-timeout-sec"` // give up on a single arm move after this long, default 30
+
+	DryRun bool `json:"dry-run"` // log where pieces would go instead of moving the arm, the game still advances
+
+	StartFEN string `json:"start-fen"` // for handicap games, defaults to the standard starting position
+
+	StateFile string `json:"state-file"` // where the game is saved, defaults to state.json in $VIAM_MODULE_DATA
+
+	ParkPosition *r3.Vector `json:"park-position"` // gripper position well clear of the board
+
+	GrabWhite *GrabConfig `json:"grab-white"` // for sets where one color is harder to grab
+	GrabBlack *GrabConfig `json:"grab-black"`
+
+	// added to the grab height by piece type, e.g. {"k": 20} to grab kings higher up, keyed by lowercase letter
+	GrabZOffsets map[string]float64 `json:"grab-z-offsets"`
+
+	// carry pieces high enough to clear the tallest piece between the squares, not just at safe-z
+	CollisionAwareTravel bool `json:"collision-aware-travel"`
+
+	// where captured pieces go, in order, instead of rows next to the board
+	CapturePositions []r3.Vector `json:"capture-positions"`
+
+	// where spare pieces for promotion sit, keyed by FEN letter, e.g. "Q" for a white queen, "n" for a black knight
+	PromotionReserve map[string]r3.Vector `json:"promotion-reserve"`
+}
+
+// GrabConfig overrides how pieces of one color are grabbed
+type GrabConfig struct {
+	ZOffset   float64 `json:"z-offset"`   // added to the grab height
+	OpenWidth float64 `json:"open-width"` // how far to open the gripper before grabbing
+}
+
+const defaultOpenWidth = 450.0
+
+// grabFor is how to grab a piece of a color, as labeled by the piece finder
+func (cfg *ChessConfig) grabFor(color int) GrabConfig {
+	g := GrabConfig{OpenWidth: cfg.gripperOpenWidth()}
+
+	var o *GrabConfig
+	switch color {
+	case 1:
+		o = cfg.GrabWhite
+	case 2:
+		o = cfg.GrabBlack
+	}
+
+	if o != nil {
+		g.ZOffset = o.ZOffset
+		if o.OpenWidth > 0 {
+			g.OpenWidth = o.OpenWidth
+		}
+	}
+	return g
+}
+
+// grabAt is how to grab whatever is on square, by the color the piece finder sees and the game's piece type
+func (s *viamChessChess) grabAt(data viscapture.VisCapture, theState *state, square string) GrabConfig {
+	g := s.conf.grabFor(s.squareColor(data, square))
+	g.ZOffset += s.conf.pieceZOffset(theState, square)
+	return g
+}
+
+func (cfg *ChessConfig) gripperOpenWidth() float64 {
+	if cfg.GripperOpenWidth <= 0 {
+		return defaultOpenWidth
+	}
+	return cfg.GripperOpenWidth
+}
+
+func (cfg *ChessConfig) grabMinWidth() float64 {
+	if cfg.GrabMinWidth <= 0 {
+		return 20
+	}
+	return cfg.GrabMinWidth
+}
+
+// pieceZOffset is the grab-z-offsets entry for what the game says is on a square
+func (cfg *ChessConfig) pieceZOffset(theState *state, square string) float64 {
+	if theState == nil || len(cfg.GrabZOffsets) == 0 {
+		return 0
+	}
+	sq, err := parseSquare(square)
+	if err != nil {
+		return 0
+	}
+	return cfg.GrabZOffsets[theState.game.Position().Board().Piece(sq).Type().String()]
 }
 
 func (cfg *ChessConfig) engine() string {
@@ -68,13 +253,196 @@ func (cfg *ChessConfig) engine() string {
 	return cfg.Engine
 }
 
+// engineOptions are the setoption commands for how strong the engine should play
+func (cfg *ChessConfig) engineOptions() []uci.Cmd {
+	cmds := []uci.Cmd{}
+	if cfg.SkillLevel != nil {
+		cmds = append(cmds, uci.CmdSetOption{Name: "Skill Level", Value: fmt.Sprintf("%d", *cfg.SkillLevel)})
+	}
+	if cfg.UCILimitStrength {
+		cmds = append(cmds,
+			uci.CmdSetOption{Name: "UCI_LimitStrength", Value: "true"},
+			uci.CmdSetOption{Name: "UCI_Elo", Value: fmt.Sprintf("%d", cfg.UCIElo)},
+		)
+	}
+	return cmds
+}
+
 func (cfg *ChessConfig) engineMillis() int {
 	if cfg.EngineMillis <= 0 {
-		return 10
+		return 100
 	}
 	return cfg.EngineMillis
 }
 
+// goCmd is how long or deep the engine searches, multiplier scales the think time
+// if only engine-depth is set, the search is depth limited and not timed
+func (cfg *ChessConfig) goCmd(multiplier float64) uci.CmdGo {
+	cmd := uci.CmdGo{Depth: cfg.EngineDepth}
+	if cfg.EngineDepth <= 0 || cfg.EngineMillis > 0 {
+		cmd.MoveTime = time.Millisecond * time.Duration(float64(cfg.engineMillis())*multiplier)
+	}
+	return cmd
+}
+
+// clockGoCmd is goCmd for a timed game, the clock's limit replaces engine-millis,
+// but engine-depth still caps the search and a multiplier under 1 still shortens it
+func (cfg *ChessConfig) clockGoCmd(multiplier float64, limit time.Duration) uci.CmdGo {
+	return uci.CmdGo{
+		Depth:    cfg.EngineDepth,
+		MoveTime: max(time.Duration(float64(limit)*min(multiplier, 1)), 50*time.Millisecond),
+	}
+}
+
+func (cfg *ChessConfig) stateFile() string {
+	if cfg.StateFile == "" {
+		return filepath.Join(os.Getenv("VIAM_MODULE_DATA"), "state.json")
+	}
+	return cfg.StateFile
+}
+
+func (cfg *ChessConfig) safeZ() float64 {
+	if cfg.SafeZ <= 0 {
+		return defaultSafeZ
+	}
+	return cfg.SafeZ
+}
+
+func (cfg *ChessConfig) highRegion() float64 {
+	if cfg.HighRegion > 0 {
+		return cfg.HighRegion
+	}
+	return cfg.SquareSize
+}
+
+func (cfg *ChessConfig) grabStep() float64 {
+	if cfg.GrabStep <= 0 {
+		return 10
+	}
+	return cfg.GrabStep
+}
+
+func (cfg *ChessConfig) grabMinZ() float64 {
+	if cfg.GrabMinZ <= 0 {
+		return 12
+	}
+	return cfg.GrabMinZ
+}
+
+func (cfg *ChessConfig) lowGrabZ() float64 {
+	if cfg.LowGrabZ <= 0 {
+		return 15
+	}
+	return cfg.LowGrabZ
+}
+
+func (cfg *ChessConfig) uprightPlaceZ() float64 {
+	if cfg.UprightPlaceZ <= 0 {
+		return 60
+	}
+	return cfg.UprightPlaceZ
+}
+
+func (cfg *ChessConfig) settleCaptures() int {
+	if cfg.SettleCaptures <= 0 {
+		return 3
+	}
+	return cfg.SettleCaptures
+}
+
+func (cfg *ChessConfig) startupRetries() int {
+	if cfg.StartupRetries <= 0 {
+		return 5
+	}
+	return cfg.StartupRetries
+}
+
+func (cfg *ChessConfig) startPosition() uint32 {
+	if cfg.StartPosition == nil {
+		return 2
+	}
+	return uint32(*cfg.StartPosition)
+}
+
+func (cfg *ChessConfig) settle() time.Duration {
+	if cfg.SettleMs <= 0 {
+		return time.Second
+	}
+	return time.Duration(cfg.SettleMs) * time.Millisecond
+}
+
+func (cfg *ChessConfig) moveTimeout() time.Duration {
+	if cfg.MoveTimeoutSec <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(cfg.MoveTimeoutSec) * time.Second
+}
+
+// robotColor is the side the robot plays, NoColor if it plays both
+func (cfg *ChessConfig) robotColor() (chess.Color, error) {
+	switch strings.ToLower(cfg.RobotColor) {
+	case "":
+		return chess.NoColor, nil
+	case "white", "w":
+		return chess.White, nil
+	case "black", "b":
+		return chess.Black, nil
+	}
+	return chess.NoColor, fmt.Errorf("robot-color has to be white or black, not %q", cfg.RobotColor)
+}
+
+// shouldResign is true if eval, from the robot's point of view, is past resign-threshold-cp or getting mated
+func (cfg *ChessConfig) shouldResign(eval *uci.Score) bool {
+	if cfg.ResignThresholdCp <= 0 || eval == nil {
+		return false
+	}
+	return eval.Mate < 0 || eval.CP <= -cfg.ResignThresholdCp
+}
+
+// robotFor is the side the robot plays in theState, which can differ from robot-color with alternate-colors
+func (cfg *ChessConfig) robotFor(theState *state) chess.Color {
+	if theState.robot != chess.NoColor {
+		return theState.robot
+	}
+	c, _ := cfg.robotColor()
+	return c
+}
+
+// robotsTurn is true if the robot should move in theState
+func (cfg *ChessConfig) robotsTurn(theState *state) bool {
+	c := cfg.robotFor(theState)
+	return c == chess.NoColor || theState.game.Position().Turn() == c
+}
+
+func (cfg *ChessConfig) calibrated() bool {
+	return cfg.BoardA1 != nil && cfg.SquareSize > 0
+}
+
+// squareCenter is where the middle of a square is for a calibrated board, Z is BoardZ
+func (cfg *ChessConfig) squareCenter(sq chess.Square) r3.Vector {
+	angle := cfg.BoardAngle * math.Pi / 180
+	along := (float64(sq.File()) + .5) * cfg.SquareSize
+	up := (float64(sq.Rank()) + .5) * cfg.SquareSize
+
+	return r3.Vector{
+		X: cfg.BoardA1.X + along*math.Cos(angle) - up*math.Sin(angle),
+		Y: cfg.BoardA1.Y + along*math.Sin(angle) + up*math.Cos(angle),
+		Z: cfg.BoardZ,
+	}
+}
+
+// onBoard is if a point is over a calibrated board
+func (cfg *ChessConfig) onBoard(p r3.Vector) bool {
+	angle := cfg.BoardAngle * math.Pi / 180
+	dx, dy := p.X-cfg.BoardA1.X, p.Y-cfg.BoardA1.Y
+
+	along := dx*math.Cos(angle) + dy*math.Sin(angle)
+	up := -dx*math.Sin(angle) + dy*math.Cos(angle)
+
+	size := 8 * cfg.SquareSize
+	return along >= 0 && along <= size && up >= 0 && up <= size
+}
+
 func (cfg *ChessConfig) Validate(path string) ([]string, []string, error) {
 	if cfg.PieceFinder == "" {
 		return nil, nil, fmt.Errorf("need a piece-finder")
@@ -88,8 +456,75 @@ func (cfg *ChessConfig) Validate(path string) ([]string, []string, error) {
 	if cfg.PoseStart == "" {
 		return nil, nil, fmt.Errorf("need a pose-start")
 	}
+	if cfg.StartPosition != nil && *cfg.StartPosition < 0 {
+		return nil, nil, fmt.Errorf("start-position can't be negative, not %d", *cfg.StartPosition)
+	}
+	if _, err := newGame(cfg.StartFEN); err != nil {
+		return nil, nil, err
+	}
+	if cfg.SafeZ < 0 {
+		return nil, nil, fmt.Errorf("safe-z has to be positive, not %v", cfg.SafeZ)
+	}
+	if cfg.TravelSpeed < 0 || cfg.PlaceSpeed < 0 {
+		return nil, nil, fmt.Errorf("travel-speed and place-speed can't be negative")
+	}
+	if cfg.GrabStep < 0 || cfg.GrabMinZ < 0 {
+		return nil, nil, fmt.Errorf("grab-step and grab-min-z can't be negative")
+	}
+	if cfg.CaptureDropZ < 0 {
+		return nil, nil, fmt.Errorf("capture-drop-z has to be positive, not %v", cfg.CaptureDropZ)
+	}
+	if cfg.HighRegion < 0 {
+		return nil, nil, fmt.Errorf("high-region has to be positive, not %v", cfg.HighRegion)
+	}
+	if cfg.SkillLevel != nil && (*cfg.SkillLevel < 0 || *cfg.SkillLevel > 20) {
+		return nil, nil, fmt.Errorf("skill-level has to be between 0 and 20, not %d", *cfg.SkillLevel)
+	}
+	if c, err := cfg.robotColor(); err != nil {
+		return nil, nil, err
+	} else if cfg.AlternateColors && c == chess.NoColor {
+		return nil, nil, fmt.Errorf("alternate-colors needs a robot-color to start with")
+	}
+	if cfg.ResignThresholdCp < 0 {
+		return nil, nil, fmt.Errorf("resign-threshold-cp is how far behind, so positive, not %d", cfg.ResignThresholdCp)
+	}
+	if cfg.TimeControl != nil && (cfg.TimeControl.BaseSec <= 0 || cfg.TimeControl.IncrementSec < 0) {
+		return nil, nil, fmt.Errorf("time-control needs a positive base-sec and an increment-sec that isn't negative")
+	}
+	if cfg.BlunderRate < 0 || cfg.BlunderRate > 1 {
+		return nil, nil, fmt.Errorf("blunder-rate has to be between 0 and 1, not %v", cfg.BlunderRate)
+	}
+	if cfg.UCILimitStrength && cfg.UCIElo <= 0 {
+		return nil, nil, fmt.Errorf("need a uci-elo if uci-limit-strength is set")
+	}
+	if cfg.ParkPosition != nil && cfg.calibrated() && cfg.onBoard(*cfg.ParkPosition) {
+		return nil, nil, fmt.Errorf("park-position %v is over the board", *cfg.ParkPosition)
+	}
 
-	return []string{cfg.PieceFinder, cfg.Arm, cfg.Gripper, cfg.PoseStart, motion.Named("builtin").String()}, nil, nil
+	if cfg.MQTTBroker != "" && cfg.MQTTTopic == "" {
+		return nil, nil, fmt.Errorf("need an mqtt-topic if using an mqtt-broker")
+	}
+	if cfg.MQTTPassword != "" && cfg.MQTTUsername == "" {
+		return nil, nil, fmt.Errorf("need an mqtt-username to go with mqtt-password")
+	}
+
+	deps := []string{cfg.PieceFinder, cfg.Arm, cfg.Gripper, cfg.PoseStart, motion.Named("builtin").String()}
+
+	if cfg.DataManager != "" {
+		if len(cfg.DatasetIDs) == 0 {
+			return nil, nil, fmt.Errorf("need dataset-ids if using a data-manager")
+		}
+		deps = append(deps, cfg.DataManager)
+	}
+
+	if cfg.Speech != "" {
+		deps = append(deps, cfg.Speech)
+	}
+	if cfg.TurnIndicator != "" {
+		deps = append(deps, cfg.TurnIndicator)
+	}
+
+	return deps, nil, nil
 }
 
 type viamChessChess struct {
@@ -103,23 +538,45 @@ type viamChessChess struct {
 	cancelCtx  context.Context
 	cancelFunc func()
 
-	pieceFinder vision.Service
-	arm         arm.Arm
-	gripper     gripper.Gripper
+	pieceFinder      vision.Service
+	pieceFinderReady error // nil once a warm-up capture worked
+	arm              arm.Arm
+	gripper          gripper.Gripper
 
-	poseStart toggleswitch.Switch
+	poseStart     toggleswitch.Switch
+	turnIndicator toggleswitch.Switch
 
 	motion motion.Service
 	rfs    framesystem.Service
 
+	dataManager datamanager.Service
+	speech      resource.Resource
+
 	startPose   *referenceframe.PoseInFrame
 	skillAdjust float64
+	armSpeed    float64 // last set_speed sent, only touched under doCommandLock
 
 	engine *uci.Engine
+	book   *chess.PolyglotBook
+	rng    *rand.Rand // all random move choices should come from here so games can be replayed
+
+	lastEval *uci.Score // robot's point of view, nil unless the last move came from the engine; set under doCommandLock and statsLock
+	bestEval *uci.Score // like lastEval, but of the engine's best line even when it blundered on purpose, for resigning
 
 	fenFile string
 
-	doCommandLock sync.Mutex
+	doCommandLock sync.Mutex   // serializes anything that moves the arm or changes the game
+	stateLock     sync.RWMutex // protects the saved game files, so reads don't wait on the arm
+	engineLock    sync.Mutex   // one search at a time, analyze doesn't wait for the arm
+
+	gameLock      sync.Mutex
+	broadcastLock sync.Mutex         // one move goes out at a time
+	stopGame      context.CancelFunc // ends the play_game or lichess game in progress, nil if there isn't one
+
+	timings        map[string]time.Duration // phases of the move in progress, only touched under doCommandLock
+	statsLock      sync.Mutex
+	lastTimings    map[string]time.Duration
+	engineRestarts int
 }
 
 func newViamChessChess(ctx context.Context, deps resource.Dependencies, rawConf resource.Config, logger logging.Logger) (resource.Resource, error) {
@@ -146,54 +603,172 @@ func NewChess(ctx context.Context, deps resource.Dependencies, name resource.Nam
 		skillAdjust: 50,
 	}
 
+	seed := conf.RandomSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.logger.Infof("random seed: %d", seed)
+	s.rng = rand.New(rand.NewSource(seed))
+
+	// check them all, so a new setup finds out everything that's misnamed at once
+	var depErrs error
+
 	s.pieceFinder, err = vision.FromProvider(deps, conf.PieceFinder)
-	if err != nil {
-		return nil, err
+	depErrs = multierr.Append(depErrs, dependencyError("piece-finder", conf.PieceFinder, err))
+	if err == nil {
+		depErrs = multierr.Append(depErrs, checkBoardSize(conf.PieceFinder, s.pieceFinder))
 	}
 
 	s.arm, err = arm.FromProvider(deps, conf.Arm)
+	depErrs = multierr.Append(depErrs, dependencyError("arm", conf.Arm, err))
+
+	s.gripper, err = gripper.FromProvider(deps, conf.Gripper)
+	depErrs = multierr.Append(depErrs, dependencyError("gripper", conf.Gripper, err))
+
+	s.poseStart, err = toggleswitch.FromProvider(deps, conf.PoseStart)
+	depErrs = multierr.Append(depErrs, dependencyError("pose-start", conf.PoseStart, err))
+
+	s.motion, err = motion.FromDependencies(deps, "builtin")
+	depErrs = multierr.Append(depErrs, dependencyError("motion", "builtin", err))
+
+	s.rfs, err = framesystem.FromDependencies(deps)
+	depErrs = multierr.Append(depErrs, dependencyError("framesystem", "", err))
+
+	if conf.DataManager != "" {
+		s.dataManager, err = datamanager.FromProvider(deps, conf.DataManager)
+		depErrs = multierr.Append(depErrs, dependencyError("data-manager", conf.DataManager, err))
+	}
+
+	if conf.Speech != "" {
+		s.speech, err = generic.FromProvider(deps, conf.Speech)
+		depErrs = multierr.Append(depErrs, dependencyError("speech", conf.Speech, err))
+	}
+
+	if conf.TurnIndicator != "" {
+		s.turnIndicator, err = toggleswitch.FromProvider(deps, conf.TurnIndicator)
+		depErrs = multierr.Append(depErrs, dependencyError("turn-indicator", conf.TurnIndicator, err))
+	}
+
+	if depErrs != nil {
+		return nil, depErrs
+	}
+
+	err = s.goToStart(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	s.gripper, err = gripper.FromProvider(deps, conf.Gripper)
+	s.pieceFinderReady = s.warmUpPieceFinder(ctx)
+	if s.pieceFinderReady != nil {
+		s.logger.Warnf("piece-finder not ready: %v", s.pieceFinderReady)
+	}
+
+	s.fenFile = conf.stateFile()
+	s.logger.Infof("fenFile: %v", s.fenFile)
+	if conf.OpeningBook != "" {
+		s.book, err = loadBook(conf.OpeningBook)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.NoEngine {
+		s.logger.Infof("no-engine set, the robot will play the first legal move")
+		return s, nil
+	}
+
+	s.engine, err = startEngine(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	s.poseStart, err = toggleswitch.FromProvider(deps, conf.PoseStart)
+	return s, nil
+}
+
+// dependencyError says which config field named a dependency that couldn't be found, nil if err is
+func dependencyError(field, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("can't get %s: %w", field, err)
+	}
+	return fmt.Errorf("can't get %s %q: %w", field, name, err)
+}
+
+func loadBook(fn string) (*chess.PolyglotBook, error) {
+	f, err := os.Open(fn)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't open opening-book: %w", err)
 	}
+	defer f.Close()
 
-	s.motion, err = motion.FromDependencies(deps, "builtin")
+	book, err := chess.LoadFromReader(f)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't read opening-book %s: %w", fn, err)
 	}
+	return book, nil
+}
 
-	s.rfs, err = framesystem.FromDependencies(deps)
+// startEngine launches the configured uci engine and gets it ready for a new game
+func startEngine(conf *ChessConfig) (*uci.Engine, error) {
+	path, err := exec.LookPath(conf.engine())
 	if err != nil {
-		logger.Errorf("can't find framesystem: %v", err)
+		return nil, fmt.Errorf("can't find chess engine %q, set engine to the path of a uci engine binary: %w", conf.engine(), err)
 	}
 
-	err = s.goToStart(ctx)
+	engine, err := uci.New(path)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't start chess engine %q: %w", path, err)
 	}
 
-	s.fenFile = os.Getenv("VIAM_MODULE_DATA") + "state.json"
-	s.logger.Infof("fenFile: %v", s.fenFile)
-	s.engine, err = uci.New(conf.engine())
+	err = engine.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame) // TODO: not sure this is correct
 	if err != nil {
-		return nil, err
+		engine.Close()
+		return nil, fmt.Errorf("chess engine %q didn't start: %w", path, err)
 	}
 
-	err = s.engine.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame) // TODO: not sure this is correct
+	err = engine.Run(append(conf.engineOptions(), uci.CmdIsReady)...)
 	if err != nil {
+		engine.Close()
 		return nil, err
 	}
 
-	return s, nil
+	return engine, nil
+}
+
+// checkBoardSize refuses a piece-finder set up for anything but 8x8, the game logic doesn't handle other boards yet;
+// one running in another process can't be checked here
+func checkBoardSize(name string, pf vision.Service) error {
+	bc, ok := pf.(*PieceFinder)
+	if !ok {
+		return nil
+	}
+	if bc.conf.files() != 8 || bc.conf.ranks() != 8 {
+		return fmt.Errorf("piece-finder %s is %d files by %d ranks, the chess service only plays on 8x8", name, bc.conf.files(), bc.conf.ranks())
+	}
+	return nil
+}
+
+// warmUpPieceFinder gives the piece-finder a chance to finish starting, backing off between captures
+func (s *viamChessChess) warmUpPieceFinder(ctx context.Context) error {
+	wait := 250 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < s.conf.startupRetries(); attempt++ {
+		_, err = s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+		if err == nil {
+			return nil
+		}
+		s.logger.Infof("piece-finder not ready yet (attempt %d): %v", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	return err
 }
 
 func (s *viamChessChess) Name() resource.Name {
@@ -204,38 +779,159 @@ func (s *viamChessChess) Name() resource.Name {
 
 type MoveCmd struct {
 	From, To string
-	N        int
+	N        int // times to move it, back and forth, default 1
+}
+
+// validate checks both squares before anything moves, to can also be "-" for the next graveyard slot
+func (m *MoveCmd) validate() error {
+	err := checkMoveSquare(m.From)
+	if err != nil {
+		return fmt.Errorf("bad move from: %w", err)
+	}
+	if m.To == "-" {
+		return nil
+	}
+	err = checkMoveSquare(m.To)
+	if err != nil {
+		return fmt.Errorf("bad move to: %w", err)
+	}
+	return nil
+}
+
+// checkMoveSquare is ok with a square on the board or a graveyard slot like X3
+func checkMoveSquare(sq string) error {
+	if strings.HasPrefix(sq, "X") {
+		n := -1
+		_, err := fmt.Sscanf(sq, "X%d", &n)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad graveyard slot [%s]", sq)
+		}
+		return nil
+	}
+	_, err := parseSquare(sq)
+	return err
+}
+
+type UprightCmd struct {
+	Square string
+	Other  string // if the piece is lying across two squares
 }
 
 type cmdStruct struct {
 	Move   MoveCmd
+	SAN    string // play this move in the game, e.g. "Nf3"
+	UCI    string // or this one, e.g. "g1f3"
 	Go     int
 	Reset  bool
 	Wipe   bool
 	Center bool
 	Skill  float64
+
+	PlayGame bool `mapstructure:"play_game"` // the engine plays both sides until the game ends
+	Stop     bool // ends play_game or lichess once the move it's on is done, doesn't wait for the lock
+
+	Lichess interface{} // a lichess game id, or true for lichess-game-id, plays it out on the board; false is off
+
+	ReadHumanMove bool `mapstructure:"read_human_move"` // look once for the move a person made
+
+	SelfTest bool `mapstructure:"self_test"` // visit every square at safe-z without grabbing
+
+	Upright UprightCmd
+
+	WaitForMove   int `mapstructure:"wait_for_move"` // seconds
+	Park          bool
+	ValidateSetup bool `mapstructure:"validate_setup"`
+
+	Demonstrate string
+	Analyze     int    // number of candidate moves to return, doesn't move the arm or wait for it
+	Hint        bool   // the best move for the side to move, without playing it
+	NewGame     bool   `mapstructure:"new_game"`
+	SetFEN      string `mapstructure:"set_fen"` // for pieces placed by hand, rejected while a move is in progress
+	Undo        int    // plies to take back, only in the saved game, the pieces have to be put back by hand
+
+	PrintBoard bool `mapstructure:"print_board"`
+	Status     bool
+	Timings    bool
+	State      bool
+	LegalMoves interface{} `mapstructure:"legal_moves"` // a square like "e2", or true for every legal move; false is off
+	PGN        bool
+	Readings   bool // game progress for the data manager
+	Captured   bool // pieces each side has lost
+
+	GameID string `mapstructure:"game_id"` // optional, which saved game any command works on
+	DryRun bool   `mapstructure:"dry_run"` // like the dry-run config, for this command only
 }
 
-func (s *viamChessChess) DoCommand(ctx context.Context, cmdMap map[string]interface{}) (map[string]interface{}, error) {
-	s.doCommandLock.Lock()
-	defer s.doCommandLock.Unlock()
+// skipsHome commands leave the arm where it is when they finish
+func (cmd *cmdStruct) skipsHome() bool {
+	return cmd.Park || cmd.NewGame || cmd.SetFEN != "" || cmd.Undo > 0
+}
+
+func (cmd *cmdStruct) wantsLegalMoves() bool {
+	return cmd.LegalMoves != nil && cmd.LegalMoves != false
+}
+
+// readOnly commands don't touch the arm or the game, so can run while a move is in progress
+func (cmd *cmdStruct) readOnly() bool {
+	return cmd.PrintBoard || cmd.Status || cmd.Timings || cmd.State || cmd.wantsLegalMoves() || cmd.PGN || cmd.Readings || cmd.Analyze > 0 || cmd.Hint || cmd.Captured
+}
+
+func (s *viamChessChess) DoCommand(ctx context.Context, cmdMap map[string]interface{}) (map[string]interface{}, error) {
+	var cmd cmdStruct
+	err := mapstructure.Decode(cmdMap, &cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(cmd.GameID, `/\`) || strings.HasPrefix(cmd.GameID, ".") {
+		return nil, fmt.Errorf("bad game_id [%s]", cmd.GameID)
+	}
+	ctx = withGameID(ctx, cmd.GameID)
+	ctx = withDryRun(ctx, cmd.DryRun)
+
+	if cmd.readOnly() {
+		return s.doReadCommand(ctx, cmd, cmdMap)
+	}
+
+	if cmd.Stop {
+		return nil, s.stop()
+	}
+
+	if cmd.SetFEN != "" {
+		if !s.doCommandLock.TryLock() {
+			return nil, fmt.Errorf("can't set_fen while a move is in progress")
+		}
+	} else {
+		s.doCommandLock.Lock()
+	}
+	defer s.doCommandLock.Unlock()
+
+	// Close stops whatever the arm is doing, not just play_game
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.cancelCtx, cancel)
+	defer stop()
 
 	defer func() {
+		if cmd.skipsHome() {
+			return
+		}
 		err := s.goToStart(ctx)
 		if err != nil {
 			s.logger.Warnf("can't go home: %v", err)
 		}
 	}()
-	var cmd cmdStruct
-	err := mapstructure.Decode(cmdMap, &cmd)
-	if err != nil {
-		return nil, err
-	}
 
-	if cmd.Move.To != "" && cmd.Move.From != "" {
+	if cmd.Move.To != "" || cmd.Move.From != "" {
+		err := cmd.Move.validate()
+		if err != nil {
+			return nil, err
+		}
+
 		s.logger.Infof("move %v to %v", cmd.Move.From, cmd.Move.To)
 
-		for x := range cmd.Move.N {
+		// recaptures every time, the pieces are somewhere else after each one
+		for x := range max(cmd.Move.N, 1) {
 			err := s.goToStart(ctx)
 			if err != nil {
 				return nil, err
@@ -259,20 +955,94 @@ func (s *viamChessChess) DoCommand(ctx context.Context, cmdMap map[string]interf
 		return nil, nil
 	}
 
-	if cmd.Go > 0 {
-		err := s.checkPositionForMoves(ctx)
+	if cmd.SAN != "" || cmd.UCI != "" {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseMove(theState.game, cmd.SAN, cmd.UCI)
+		if err != nil {
+			return nil, err
+		}
+		s.timings = map[string]time.Duration{}
+		defer s.finishTimings(time.Now())
+		err = s.goToStart(ctx)
+		if err != nil {
+			return nil, err
+		}
+		over, err := s.playMove(ctx, theState, m)
+		if err != nil {
+			return nil, err
+		}
+		ret := map[string]interface{}{"move": m.String()}
+		for k, v := range over {
+			ret[k] = v
+		}
+		return ret, nil
+	}
+
+	if cmd.Go > 0 || cmd.PlayGame {
+		if s.conf.VerifySetup {
+			err := s.verifyStartingPosition(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err := s.checkPositionForMoves(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.PlayGame {
+		return s.playGame(ctx)
+	}
+
+	if cmd.Lichess != nil {
+		gameID, err := lichessGame(cmd.Lichess, s.conf.LichessGameID)
 		if err != nil {
 			return nil, err
 		}
+		if gameID != "" {
+			if s.conf.LichessToken == "" {
+				return nil, fmt.Errorf("need a lichess-token to play on lichess")
+			}
+			return s.playLichess(ctx, newLichessClient(s.conf.LichessToken), gameID)
+		}
+	}
 
+	if cmd.Go > 0 {
 		var m *chess.Move
+		var over map[string]interface{}
 		for range cmd.Go {
-			m, err = s.makeAMove(ctx)
+			var err error
+			m, over, err = s.makeAMove(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if over != nil {
+				break
+			}
+		}
+		ret := map[string]interface{}{}
+		if m != nil {
+			ret["move"] = m.String()
+			theState, err := s.getGame(ctx)
 			if err != nil {
 				return nil, err
 			}
+			for k, v := range lastCapture(theState.game) {
+				ret[k] = v
+			}
 		}
-		return map[string]interface{}{"move": m.String()}, nil
+		if s.lastEval != nil {
+			addEval(ret, *s.lastEval)
+		}
+		for k, v := range over {
+			ret[k] = v
+		}
+		return ret, nil
 	}
 
 	if cmd.Reset {
@@ -283,10 +1053,103 @@ func (s *viamChessChess) DoCommand(ctx context.Context, cmdMap map[string]interf
 		return nil, s.wipe(ctx)
 	}
 
+	if cmd.SetFEN != "" {
+		return nil, s.setFEN(ctx, cmd.SetFEN)
+	}
+
+	if cmd.Undo > 0 {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		theState, err = undo(theState, cmd.Undo, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		err = s.saveGame(ctx, theState)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"fen": theState.game.FEN()}, nil
+	}
+
+	if cmd.NewGame {
+		theState, err := s.startNewGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret := map[string]interface{}{"fen": theState.game.FEN()}
+		if c := s.conf.robotFor(theState); c != chess.NoColor {
+			ret["robot_color"] = strings.ToLower(c.Name())
+		}
+		return ret, nil
+	}
+
 	if cmd.Center {
 		return nil, s.centerCamera(ctx)
 	}
 
+	if cmd.Park {
+		return nil, s.park(ctx)
+	}
+
+	if cmd.ValidateSetup {
+		return s.validateSetup(ctx), nil
+	}
+
+	if cmd.SelfTest {
+		return s.selfTest(ctx)
+	}
+
+	if cmd.WaitForMove > 0 {
+		m, err := s.waitForMove(ctx, time.Duration(cmd.WaitForMove)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		ret := map[string]interface{}{"move": m.String()}
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range gameOver(theState.game) {
+			ret[k] = v
+		}
+		return ret, nil
+	}
+
+	if cmd.ReadHumanMove {
+		m, err := s.checkPositionForMoves(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			s.showTurn(ctx, false)
+			return nil, fmt.Errorf("no move found, the board matches the game")
+		}
+		s.showTurn(ctx, true)
+		ret := map[string]interface{}{"move": m.String()}
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range gameOver(theState.game) {
+			ret[k] = v
+		}
+		return ret, nil
+	}
+
+	if cmd.Demonstrate != "" {
+		return nil, s.demonstrate(ctx, cmd.Demonstrate)
+	}
+
+	if cmd.Upright.Square != "" {
+		all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.uprightPiece(ctx, all, cmd.Upright)
+	}
+
 	if cmd.Skill > 0 {
 		s.skillAdjust = cmd.Skill
 		return nil, nil
@@ -295,6 +1158,244 @@ func (s *viamChessChess) DoCommand(ctx context.Context, cmdMap map[string]interf
 	return nil, fmt.Errorf("bad cmd %v", cmdMap)
 }
 
+func (s *viamChessChess) doReadCommand(ctx context.Context, cmd cmdStruct, cmdMap map[string]interface{}) (map[string]interface{}, error) {
+	if cmd.PrintBoard {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"board": theState.game.Position().Board().Draw()}, nil
+	}
+
+	if cmd.Status {
+		return s.status(), nil
+	}
+
+	if cmd.Timings {
+		return s.lastTimingsMillis(), nil
+	}
+
+	if cmd.State {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret := gameState(theState.game)
+		if theState.clock != nil {
+			addClock(ret, theState.clock, theState.game, time.Now())
+		}
+		return ret, nil
+	}
+
+	if cmd.PGN {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"pgn": gamePGN(theState.game)}, nil
+	}
+
+	if cmd.Readings {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.statsLock.Lock()
+		eval := s.lastEval
+		s.statsLock.Unlock()
+		return readings(theState.game, eval), nil
+	}
+
+	if cmd.Captured {
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return capturedPieces(theState.game), nil
+	}
+
+	if cmd.wantsLegalMoves() {
+		from := ""
+		switch v := cmd.LegalMoves.(type) {
+		case string:
+			from = v
+		case bool:
+		default:
+			return nil, fmt.Errorf("legal_moves needs a square or true, not %v", v)
+		}
+
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		moves, err := legalMoves(theState.game, from)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"moves": moves}, nil
+	}
+
+	if cmd.Analyze > 0 {
+		moves, err := s.analyze(ctx, cmd.Analyze)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"moves": moves}, nil
+	}
+
+	if cmd.Hint {
+		moves, err := s.analyze(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(moves) == 0 {
+			return nil, fmt.Errorf("no move to suggest, is the game over?")
+		}
+		return moves[0].(map[string]interface{}), nil
+	}
+
+	return nil, fmt.Errorf("bad cmd %v", cmdMap)
+}
+
+// gameState is what a UI needs to show the game without reading the state file
+func gameState(game *chess.Game) map[string]interface{} {
+	claimDraw(game)
+	pos := game.Position()
+	ret := map[string]interface{}{
+		"fen":     game.FEN(),
+		"turn":    strings.ToLower(pos.Turn().Name()),
+		"check":   inCheck(game),
+		"outcome": game.Outcome().String(),
+		"method":  game.Method().String(),
+	}
+	if f := strings.Fields(game.FEN()); len(f) == 6 {
+		ret["move_number"] = f[5]
+	}
+	return ret
+}
+
+// readings is a snapshot of the game for logging over time, eval is the robot's last one if there is one
+func readings(game *chess.Game, eval *uci.Score) map[string]interface{} {
+	moves := game.Moves()
+	ret := map[string]interface{}{
+		"turn":      strings.ToLower(game.Position().Turn().Name()),
+		"ply":       len(moves),
+		"last_move": "",
+		"outcome":   game.Outcome().String(),
+	}
+	if len(moves) > 0 {
+		ret["last_move"] = moves[len(moves)-1].String()
+	}
+	if eval != nil {
+		addEval(ret, *eval)
+	}
+	return ret
+}
+
+// capturedPieces is what each side has lost, in the order they were taken, from the game's moves
+func capturedPieces(game *chess.Game) map[string]interface{} {
+	lost := map[chess.Color][]interface{}{chess.White: {}, chess.Black: {}}
+	positions := game.Positions()
+	for i, m := range game.Moves() {
+		if pc := capturedBy(positions[i].Board(), m); pc != chess.NoPiece {
+			lost[pc.Color()] = append(lost[pc.Color()], pieceNames[pc.Type()])
+		}
+	}
+	return map[string]interface{}{"white": lost[chess.White], "black": lost[chess.Black]}
+}
+
+// capturedBy is the piece m takes on board, NoPiece if it isn't a capture
+func capturedBy(board *chess.Board, m *chess.Move) chess.Piece {
+	if m.HasTag(chess.EnPassant) {
+		return board.Piece(chess.NewSquare(m.S2().File(), m.S1().Rank()))
+	}
+	return board.Piece(m.S2())
+}
+
+// lastCapture says if the last move in game was a capture, and of what
+func lastCapture(game *chess.Game) map[string]interface{} {
+	moves := game.Moves()
+	if len(moves) == 0 {
+		return map[string]interface{}{"is_capture": false}
+	}
+	positions := game.Positions()
+	pc := capturedBy(positions[len(moves)-1].Board(), moves[len(moves)-1])
+	if pc == chess.NoPiece {
+		return map[string]interface{}{"is_capture": false}
+	}
+	return map[string]interface{}{"is_capture": true, "captured": pieceNames[pc.Type()]}
+}
+
+// legalMoves in UCI notation, only from one square if from is set.
+// Castling is the king's move, e.g. e1g1, and promotions end with the piece, e.g. e7e8q.
+func legalMoves(game *chess.Game, from string) ([]interface{}, error) {
+	var sq chess.Square
+	if from != "" {
+		var err error
+		sq, err = parseSquare(from)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret := []interface{}{}
+	for _, m := range game.ValidMoves() {
+		if from != "" && m.S1() != sq {
+			continue
+		}
+		ret = append(ret, m.String())
+	}
+	return ret, nil
+}
+
+// inCheck is if the side to move is in check, which the last move's Check tag says.
+// Only a game with no moves to go by, like one from set_fen, has to work it out from the position.
+func inCheck(game *chess.Game) bool {
+	moves := game.Moves()
+	positions := game.Positions()
+	if len(moves) > 0 && positions[len(positions)-1].String() == game.Position().String() {
+		return moves[len(moves)-1].HasTag(chess.Check)
+	}
+	return positionInCheck(game.Position())
+}
+
+// positionInCheck is inCheck from the position alone, the chess library doesn't export this.
+// The opponent's king is taken off so none of their moves are ruled out for exposing it,
+// then it's check if any of their moves could take our king.
+func positionInCheck(pos *chess.Position) bool {
+	squares := pos.Board().SquareMap()
+	for sq, p := range squares {
+		if p.Type() == chess.King && p.Color() != pos.Turn() {
+			delete(squares, sq)
+		}
+	}
+
+	f, err := chess.FEN(fmt.Sprintf("%s %s - - 0 1", chess.NewBoard(squares).String(), pos.Turn().Other().String()))
+	if err != nil {
+		return false
+	}
+	for _, m := range chess.NewGame(f).ValidMoves() {
+		if p := pos.Board().Piece(m.S2()); p.Type() == chess.King && p.Color() == pos.Turn() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *viamChessChess) status() map[string]interface{} {
+	ret := map[string]interface{}{
+		"piece_finder_ready": s.pieceFinderReady == nil,
+		"last_move_timings":  s.lastTimingsMillis(),
+	}
+	s.statsLock.Lock()
+	ret["engine_restarts"] = s.engineRestarts
+	s.statsLock.Unlock()
+	if s.pieceFinderReady != nil {
+		ret["piece_finder_error"] = s.pieceFinderReady.Error()
+	}
+	return ret
+}
+
 func (s *viamChessChess) Close(context.Context) error {
 	var err error
 
@@ -316,6 +1417,21 @@ func (s *viamChessChess) findObject(data viscapture.VisCapture, pos string) *viz
 	return nil
 }
 
+// objectLabel is an object's label without the piece finder's confidence, e.g. e4-1-Q
+func objectLabel(o *viz.Object) string {
+	label, _ := splitConfidence(o.Geometry.Label())
+	return label
+}
+
+// squareColor is what the piece finder thinks is on a square, 0 if empty or not a square
+func (s *viamChessChess) squareColor(data viscapture.VisCapture, pos string) int {
+	o := s.findObject(data, pos)
+	if o == nil {
+		return 0
+	}
+	return int(o.Geometry.Label()[3] - '0')
+}
+
 func (s *viamChessChess) findDetection(data viscapture.VisCapture, pos string) objectdetection.Detection {
 	for _, d := range data.Detections {
 		if strings.HasPrefix(d.Label(), pos) {
@@ -325,7 +1441,16 @@ func (s *viamChessChess) findDetection(data viscapture.VisCapture, pos string) o
 	return nil
 }
 
+// graveyardPosition is where the pos'th captured piece goes, the capture-positions if configured,
+// otherwise in rows off the a-file side of the board
 func (s *viamChessChess) graveyardPosition(data viscapture.VisCapture, pos int) (r3.Vector, error) {
+	if len(s.conf.CapturePositions) > 0 {
+		if pos >= len(s.conf.CapturePositions) {
+			return r3.Vector{}, fmt.Errorf("capture %d but only %d capture-positions", pos+1, len(s.conf.CapturePositions))
+		}
+		return s.conf.CapturePositions[pos], nil
+	}
+
 	f := 8 - (pos % 8)
 	ex := 1 + (pos / 8)
 
@@ -345,7 +1470,19 @@ func (s *viamChessChess) getCenterFor(data viscapture.VisCapture, pos string, th
 		if s == nil {
 			return r3.Vector{400, -400, 200}, nil
 		}
-		return s.graveyardPosition(data, len(theState.graveyard))
+		n := 0
+		if theState != nil {
+			n = len(theState.graveyard)
+		}
+		return s.graveyardPosition(data, n)
+	}
+
+	if strings.HasPrefix(pos, reservePrefix) {
+		p, ok := s.conf.PromotionReserve[pos[len(reservePrefix):]]
+		if !ok {
+			return r3.Vector{}, fmt.Errorf("no promotion-reserve for %s", pos)
+		}
+		return p, nil
 	}
 
 	if pos[0] == 'X' {
@@ -358,19 +1495,32 @@ func (s *viamChessChess) getCenterFor(data viscapture.VisCapture, pos string, th
 		return s.graveyardPosition(data, x)
 	}
 
+	if s != nil && s.conf.calibrated() {
+		return s.getCalibratedCenterFor(data, pos)
+	}
+
 	o := s.findObject(data, pos)
 	if o == nil {
-		return r3.Vector{}, fmt.Errorf("can't find object for: %s", pos)
+		return r3.Vector{}, &PieceNotFoundError{pos}
+	}
+
+	empty := strings.HasSuffix(objectLabel(o), "-0")
+	region := 0.0
+	if s != nil {
+		region = s.conf.highRegion()
+	}
+	if center, ok := squareWorldCenter(o, !empty, region); ok {
+		return center, nil
 	}
 
 	md := o.MetaData()
 	center := md.Center()
 
-	if strings.HasSuffix(o.Geometry.Label(), "-0") {
+	if empty {
 		return center, nil
 	}
 
-	high := touch.PCFindHighestInRegion(o, image.Rect(-1000, -1000, 1000, 1000))
+	high := s.squareTop(o, pos)
 	return r3.Vector{
 		X: (center.X + high.X) / 2,
 		Y: (center.Y + high.Y) / 2,
@@ -378,330 +1528,2230 @@ func (s *viamChessChess) getCenterFor(data viscapture.VisCapture, pos string, th
 	}, nil
 }
 
-func (s *viamChessChess) movePiece(ctx context.Context, data viscapture.VisCapture, theState *state, from, to string, m *chess.Move) error {
-	s.logger.Infof("movePiece called: %s -> %s", from, to)
-	if to != "-" && to[0] != 'X' { // check where we're going
-		o := s.findObject(data, to)
-		if o == nil {
-			return fmt.Errorf("can't find object for: %s", to)
+// squareTop is the highest point of what's on pos, only looking within high-region of the middle of the square,
+// or as much as the board showing in the square's cloud covers if high-region and square-size aren't set
+func (s *viamChessChess) squareTop(pc pointcloud.PointCloud, pos string) r3.Vector {
+	md := pc.MetaData()
+	center := md.Center()
+	size := 0.0
+	if middle, boardSize, ok := boardSquare(pc); ok {
+		center, size = middle, boardSize
+	}
+	if s != nil {
+		if s.conf.highRegion() > 0 {
+			size = s.conf.highRegion()
 		}
+		if sq, err := parseSquare(pos); err == nil && s.conf.calibrated() {
+			center = s.conf.squareCenter(sq)
+		}
+	}
+	return highestNear(pc, center, size)
+}
 
-		if !strings.HasSuffix(o.Geometry.Label(), "-0") {
+// highestNear is the highest point within a size wide box around center, or in all of pc if size is 0 or there's nothing in the box
+func highestNear(pc pointcloud.PointCloud, center r3.Vector, size float64) r3.Vector {
+	everywhere := image.Rect(-1000, -1000, 1000, 1000)
+	if size <= 0 {
+		return touch.PCFindHighestInRegion(pc, everywhere)
+	}
 
-			what := "?"
+	box := image.Rect(
+		int(math.Floor(center.X-size/2)),
+		int(math.Floor(center.Y-size/2)),
+		int(math.Ceil(center.X+size/2)),
+		int(math.Ceil(center.Y+size/2)),
+	)
+	high := touch.PCFindHighestInRegion(pc, box)
+	if high.Z == -100000 { // nothing in the box
+		return touch.PCFindHighestInRegion(pc, everywhere)
+	}
+	return high
+}
 
-			s.logger.Infof("position %s already has a piece (%s) (%s), will move", to, what, o.Geometry.Label())
-			err := s.movePiece(ctx, data, theState, to, "-", nil)
-			if err != nil {
-				return fmt.Errorf("can't move piece out of the way: %w", err)
-			}
+const (
+	boardBand      = 5.0  // mm, points this close to the lowest in a square are the board
+	pieceClearance = 10.0 // mm, points this far above the board are a piece
+	pieceRadius    = 30.0 // mm around the top of a piece that's still that piece
+)
 
-			if theState != nil {
-				pc := theState.game.Position().Board().Piece(m.S2())
-				theState.graveyard = append(theState.graveyard, int(pc))
-			}
+// boardSquare is the middle of the board showing in a square's points and how wide that is, false if no board shows
+func boardSquare(pc pointcloud.PointCloud) (r3.Vector, float64, bool) {
+	if pc.Size() == 0 {
+		return r3.Vector{}, 0, false
+	}
+	md := pc.MetaData()
+	low := md.MinZ
+
+	var sum r3.Vector
+	n := 0
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		if p.Z > low+boardBand {
+			return true
+		}
+		sum = sum.Add(p)
+		n++
+		minX, minY = min(minX, p.X), min(minY, p.Y)
+		maxX, maxY = max(maxX, p.X), max(maxY, p.Y)
+		return true
+	})
+	if n == 0 {
+		return r3.Vector{}, 0, false
+	}
+	return sum.Mul(1 / float64(n)), max(maxX-minX, maxY-minY), true
+}
+
+// squareWorldCenter is where to grab or put down on a square, from its points in world coordinates.
+// A camera that isn't straight overhead sees the board past a piece, and the sides of its neighbors, in the square's
+// image box, so the middle of all the points is off. Instead it's the middle of the piece's own points, or for an
+// empty square the middle of the board's. A piece is only looked for in a region wide box around the middle of the
+// board, as wide as the board showing if region is 0, so a taller neighbor leaning into the box isn't taken for it.
+// ok is false if the cloud doesn't have enough to go on.
+func squareWorldCenter(pc pointcloud.PointCloud, occupied bool, region float64) (r3.Vector, bool) {
+	if pc.Size() == 0 {
+		return r3.Vector{}, false
+	}
+	middle, boardSize, ok := boardSquare(pc)
+	if !occupied {
+		return middle, ok
+	}
+
+	md := pc.MetaData()
+	low := md.MinZ
+	if !ok {
+		middle = md.Center()
+	} else if region <= 0 {
+		region = boardSize
+	}
+	inRegion := func(p r3.Vector) bool {
+		return region <= 0 || (math.Abs(p.X-middle.X) <= region/2 && math.Abs(p.Y-middle.Y) <= region/2)
+	}
+
+	top := r3.Vector{Z: math.Inf(-1)}
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		if p.Z > top.Z && inRegion(p) {
+			top = p
+		}
+		return true
+	})
 
+	var sum r3.Vector
+	n := 0
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		if p.Z < low+pieceClearance || math.Hypot(p.X-top.X, p.Y-top.Y) > pieceRadius || !inRegion(p) {
+			return true
 		}
+		sum = sum.Add(p)
+		n++
+		return true
+	})
+	if n == 0 {
+		return r3.Vector{}, false
 	}
 
-	useZ := 100.0
+	center := sum.Mul(1 / float64(n))
+	center.Z = top.Z
+	return center, true
+}
 
-	{
-		center, err := s.getCenterFor(data, from, theState)
-		if err != nil {
-			return err
+// getCalibratedCenterFor uses the configured board geometry for X and Y, only taking Z from vision
+func (s *viamChessChess) getCalibratedCenterFor(data viscapture.VisCapture, pos string) (r3.Vector, error) {
+	sq, err := parseSquare(pos)
+	if err != nil {
+		return r3.Vector{}, err
+	}
+
+	center := s.conf.squareCenter(sq)
+
+	o := s.findObject(data, pos)
+	if o == nil {
+		if s.conf.BoardZ <= 0 {
+			return r3.Vector{}, fmt.Errorf("%w and no board-z", &PieceNotFoundError{pos})
 		}
-		useZ = center.Z
+		return center, nil
+	}
+
+	if strings.HasSuffix(objectLabel(o), "-0") {
+		md := o.MetaData()
+		center.Z = md.Center().Z
+	} else {
+		center.Z = s.squareTop(o, pos).Z
+	}
+
+	return center, nil
+}
 
-		err = s.setupGripper(ctx)
+const reservePrefix = "reserve-"
+
+// reserveKey is the promotion-reserve key for a piece, its FEN letter
+func reserveKey(p chess.Piece) string {
+	if p.Color() == chess.White {
+		return strings.ToUpper(p.Type().String())
+	}
+	return p.Type().String()
+}
+
+// promote swaps the pawn for the piece it's promoting to, taken from the promotion-reserve
+func (s *viamChessChess) promote(ctx context.Context, data viscapture.VisCapture, theState *state, m *chess.Move) error {
+	board := theState.game.Position().Board()
+	pawn := board.Piece(m.S1())
+
+	key := reserveKey(chess.NewPiece(m.Promo(), pawn.Color()))
+	if _, ok := s.conf.PromotionReserve[key]; !ok {
+		return fmt.Errorf("no promotion-reserve for %s", key)
+	}
+
+	if captured := board.Piece(m.S2()); captured != chess.NoPiece {
+		err := s.movePiece(ctx, data, theState, m.S2().String(), "-", nil)
 		if err != nil {
-			return err
+			return fmt.Errorf("can't move piece out of the way: %w", err)
 		}
+		theState.graveyard = append(theState.graveyard, int(captured))
+	}
+
+	err := s.movePiece(ctx, data, theState, m.S1().String(), "-", nil)
+	if err != nil {
+		return fmt.Errorf("can't remove promoting pawn: %w", err)
+	}
+	theState.graveyard = append(theState.graveyard, int(pawn))
+
+	// the board has changed under us, so look again before placing the new piece
+	err = s.goToStart(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err = s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.movePiece(ctx, data, theState, reservePrefix+key, m.S2().String(), nil)
+}
+
+// planMoves is the list of from/to pieces that have to physically move for a move.
+// A castle is the king then the rook, en passant takes the captured pawn, which is beside us, off first.
+func planMoves(m *chess.Move) ([][2]string, error) {
+	if m.HasTag(chess.EnPassant) {
+		captured := chess.NewSquare(m.S2().File(), m.S1().Rank())
+		return [][2]string{
+			{captured.String(), "-"},
+			{m.S1().String(), m.S2().String()},
+		}, nil
+	}
+
+	if !m.HasTag(chess.KingSideCastle) && !m.HasTag(chess.QueenSideCastle) {
+		return [][2]string{{m.S1().String(), m.S2().String()}}, nil
+	}
+
+	var rookFrom, rookTo string
+	switch m.S2() {
+	case chess.G1:
+		rookFrom, rookTo = "h1", "f1"
+	case chess.C1:
+		rookFrom, rookTo = "a1", "d1"
+	case chess.G8:
+		rookFrom, rookTo = "h8", "f8"
+	case chess.C8:
+		rookFrom, rookTo = "a8", "d8"
+	default:
+		return nil, fmt.Errorf("bad castle? %v", m)
+	}
+
+	return [][2]string{
+		{m.S1().String(), m.S2().String()},
+		{rookFrom, rookTo},
+	}, nil
+}
+
+func (s *viamChessChess) movePiece(ctx context.Context, data viscapture.VisCapture, theState *state, from, to string, m *chess.Move) error {
+	s.logger.Infof("movePiece called: %s -> %s", from, to)
 
-		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, safeZ})
+	if m != nil && (m.HasTag(chess.KingSideCastle) || m.HasTag(chess.QueenSideCastle) || m.HasTag(chess.EnPassant)) {
+		plan, err := planMoves(m)
 		if err != nil {
 			return err
 		}
-
-		for {
-			err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, useZ})
-			if err != nil {
-				return err
+		for _, p := range plan {
+			var captured chess.Piece
+			if p[1] == "-" && theState != nil {
+				sq, err := parseSquare(p[0])
+				if err != nil {
+					return err
+				}
+				captured = theState.game.Position().Board().Piece(sq)
 			}
 
-			got, err := s.myGrab(ctx)
+			err = s.movePiece(ctx, data, theState, p[0], p[1], nil)
 			if err != nil {
 				return err
 			}
-			if got {
-				break
-			}
 
-			useZ -= 10
-			if useZ < 12 { // todo: magic number
-				return fmt.Errorf("couldn't grab, and scared to go lower")
+			if captured != chess.NoPiece {
+				theState.graveyard = append(theState.graveyard, int(captured))
 			}
+		}
+		return nil
+	}
+
+	if to != "-" && to[0] != 'X' { // check where we're going
+		o := s.findObject(data, to)
+		if o == nil {
+			return &PieceNotFoundError{to}
+		}
+
+		if !strings.HasSuffix(objectLabel(o), "-0") {
 
-			s.logger.Warnf("didn't grab, going to try a little more")
+			what := "?"
 
-			err = s.setupGripper(ctx)
+			s.logger.Infof("position %s already has a piece (%s) (%s), will move", to, what, o.Geometry.Label())
+			err := s.movePiece(ctx, data, theState, to, "-", nil)
 			if err != nil {
-				return err
+				return fmt.Errorf("can't move piece out of the way: %w", err)
+			}
+
+			if theState != nil {
+				// m is nil for the steps of a castle or promotion, so go by the square
+				sq, err := parseSquare(to)
+				if err != nil {
+					return err
+				}
+				pc := theState.game.Position().Board().Piece(sq)
+				theState.graveyard = append(theState.graveyard, int(pc))
 			}
-			time.Sleep(250 * time.Millisecond)
-		}
 
-		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, safeZ})
-		if err != nil {
-			return err
 		}
 	}
 
-	{
-		center, err := s.getCenterFor(data, to, theState)
-		if err != nil {
-			return err
-		}
+	center, err := s.getCenterFor(data, from, theState)
+	if err != nil {
+		return err
+	}
 
-		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, safeZ})
-		if err != nil {
-			return err
-		}
+	g := s.grabAt(data, theState, from)
 
-		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, useZ})
-		if err != nil {
-			return err
-		}
+	if s.dryRun(ctx) {
+		return s.planPiece(data, theState, from, to, center, center.Z+g.ZOffset)
+	}
+
+	useZ, err := s.pickUp(ctx, from, center, g)
+	s.uploadGrab(ctx, data, from, center, useZ, err)
+	if err != nil {
+		return err
+	}
 
-		err = s.setupGripper(ctx)
+	travelZ := s.conf.safeZ()
+	if s.conf.CollisionAwareTravel {
+		travelZ, err = s.travelZ(data, from, to, useZ)
 		if err != nil {
 			return err
 		}
+		if travelZ > s.conf.safeZ() {
+			s.logger.Infof("lifting to %0.1f to clear pieces between %s and %s", travelZ, from, to)
+			err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, travelZ})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	center, err = s.getCenterFor(data, to, theState)
+	if err != nil {
+		return err
+	}
+
+	if to == "-" && s.conf.CaptureDropZ > 0 {
+		useZ = s.conf.CaptureDropZ
+	}
+
+	return s.putDownFrom(ctx, center, useZ, travelZ)
+}
 
-		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, safeZ})
+// planPiece logs what movePiece would do with the arm, for dry-run
+func (s *viamChessChess) planPiece(data viscapture.VisCapture, theState *state, from, to string, center r3.Vector, useZ float64) error {
+	travelZ := s.conf.safeZ()
+	if s.conf.CollisionAwareTravel {
+		var err error
+		travelZ, err = s.travelZ(data, from, to, useZ)
 		if err != nil {
 			return err
 		}
 	}
 
+	dest, err := s.getCenterFor(data, to, theState)
+	if err != nil {
+		return err
+	}
+
+	dropZ := useZ
+	if to == "-" && s.conf.CaptureDropZ > 0 {
+		dropZ = s.conf.CaptureDropZ
+	}
+
+	s.logger.Infof("dry run: grab %s at (%0.1f, %0.1f, %0.1f), carry at z %0.1f, put down %s at (%0.1f, %0.1f, %0.1f)",
+		from, center.X, center.Y, useZ, travelZ, to, dest.X, dest.Y, dropZ)
 	return nil
 }
 
-func (s *viamChessChess) goToStart(ctx context.Context) error {
-	err := s.poseStart.SetPosition(ctx, 2, nil)
+// travelZ is how high to carry a piece grabbed at useZ from one square to another,
+// so its bottom clears the tallest piece in the rectangle of squares between them.
+// The board's height comes from the empty squares in the rectangle, or board-z if they're all full.
+func (s *viamChessChess) travelZ(data viscapture.VisCapture, from, to string, useZ float64) (float64, error) {
+	safe := s.conf.safeZ()
+
+	f, err := parseSquare(from)
 	if err != nil {
-		return err
+		return safe, nil
 	}
-	err = s.gripper.Open(ctx, nil)
+	t, err := parseSquare(to)
 	if err != nil {
-		return err
+		return safe, nil
 	}
 
-	time.Sleep(time.Second)
-
-	s.startPose, err = s.rfs.GetPose(ctx, s.conf.Gripper, "world", nil, nil)
-	if err != nil {
-		return err
+	boardZ := math.Inf(1)
+	tallest := math.Inf(-1)
+	for file := min(f.File(), t.File()); file <= max(f.File(), t.File()); file++ {
+		for rank := min(f.Rank(), t.Rank()); rank <= max(f.Rank(), t.Rank()); rank++ {
+			sq := chess.NewSquare(file, rank)
+			o := s.findObject(data, sq.String())
+			if o == nil {
+				continue
+			}
+			if strings.HasSuffix(objectLabel(o), "-0") {
+				md := o.MetaData()
+				boardZ = min(boardZ, md.Center().Z)
+				continue
+			}
+			if sq == f {
+				continue // that's the piece we're carrying
+			}
+			tallest = max(tallest, s.squareTop(o, sq.String()).Z)
+		}
 	}
 
-	return nil
-}
+	if math.IsInf(tallest, -1) {
+		return safe, nil
+	}
+	if math.IsInf(boardZ, 1) {
+		if s.conf.BoardZ <= 0 {
+			return 0, fmt.Errorf("no empty square between %s and %s to tell how high the board is, set board-z", from, to)
+		}
+		boardZ = s.conf.BoardZ
+	}
 
-func (s *viamChessChess) setupGripper(ctx context.Context) error {
-	_, err := s.arm.DoCommand(ctx, map[string]interface{}{"move_gripper": 450.0})
-	return err
+	const clearance = 20.0
+	return max(safe, tallest+(useZ-boardZ)+clearance), nil
 }
 
-func (s *viamChessChess) moveGripper(ctx context.Context, p r3.Vector) error {
+// pickUp grabs the piece at center, going lower until it has it, and returns the height it grabbed at
+func (s *viamChessChess) pickUp(ctx context.Context, square string, center r3.Vector, g GrabConfig) (float64, error) {
+	useZ := center.Z + g.ZOffset
 
-	orientation := &spatialmath.OrientationVectorDegrees{
-		OZ:    -1,
-		Theta: s.startPose.Pose().Orientation().OrientationVectorDegrees().Theta,
+	err := s.openGripper(ctx, g.OpenWidth)
+	if err != nil {
+		return 0, err
 	}
 
-	if p.X > 300 {
-		orientation.OX = (p.X - 300) / 1000
+	err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, s.conf.safeZ()})
+	if err != nil {
+		return 0, err
 	}
 
-	if p.Y < -300 {
-		orientation.OY = (p.Y + 300) / 300
-		orientation.OX += .2
+	for {
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("stopped grabbing: %w", ctx.Err())
+		}
+
+		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, useZ})
+		if err != nil {
+			return 0, err
+		}
+
+		got, err := s.myGrab(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if got {
+			break
+		}
+
+		useZ -= s.conf.grabStep()
+		if useZ < s.conf.grabMinZ() {
+			return 0, &GrabFailedError{square, s.conf.grabMinZ()}
+		}
+
+		s.logger.Warnf("didn't grab, going to try a little more")
+
+		err = s.openGripper(ctx, g.OpenWidth)
+		if err != nil {
+			return 0, err
+		}
+		err = sleep(ctx, 250*time.Millisecond)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	myPose := spatialmath.NewPose(p, orientation)
-	_, err := s.motion.Move(ctx, motion.MoveReq{
-		ComponentName: s.conf.Gripper,
-		Destination:   referenceframe.NewPoseInFrame("world", myPose),
-	})
+	err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, s.conf.safeZ()})
 	if err != nil {
-		return fmt.Errorf("can't move to %v: %w", myPose, err)
+		return 0, err
 	}
-	return nil
-}
 
-type state struct {
-	game      *chess.Game
-	graveyard []int
+	return useZ, nil
 }
 
-type savedState struct {
-	FEN       string `json:"fen"`
-	Graveyard []int  `json:"graveyard"`
+// uploadGrab sends what the camera saw and how a grab went to the data manager, failures are only logged
+func (s *viamChessChess) uploadGrab(ctx context.Context, data viscapture.VisCapture, square string, center r3.Vector, useZ float64, grabErr error) {
+	if s.dataManager == nil {
+		return
+	}
+
+	outcome := "grab:ok"
+	if grabErr != nil {
+		outcome = "grab:failed"
+	}
+	tags := []string{
+		"square:" + square,
+		fmt.Sprintf("grab-point:%0.1f,%0.1f,%0.1f", center.X, center.Y, useZ),
+		outcome,
+	}
+
+	if data.Image != nil {
+		err := s.dataManager.UploadImageToDatasets(ctx, data.Image, s.conf.DatasetIDs, tags, datasyncpb.MimeType_MIME_TYPE_IMAGE_JPEG, nil)
+		if err != nil {
+			s.logger.Warnf("can't upload image: %v", err)
+		}
+	}
+
+	o := s.findObject(data, square)
+	if o != nil {
+		b, err := pointcloud.ToBytes(o.PointCloud)
+		if err != nil {
+			s.logger.Warnf("can't encode point cloud: %v", err)
+			return
+		}
+		err = s.dataManager.UploadBinaryDataToDatasets(ctx, b, s.conf.DatasetIDs, tags, datasyncpb.MimeType_MIME_TYPE_APPLICATION_PCD, nil)
+		if err != nil {
+			s.logger.Warnf("can't upload point cloud: %v", err)
+		}
+	}
 }
 
-func (s *viamChessChess) getGame(ctx context.Context) (*state, error) {
-	return readState(ctx, s.fenFile)
+// putDown places the piece being held at center, letting go at the height it was grabbed at
+func (s *viamChessChess) putDown(ctx context.Context, center r3.Vector, useZ float64) error {
+	return s.putDownFrom(ctx, center, useZ, s.conf.safeZ())
 }
 
-func readState(ctx context.Context, fn string) (*state, error) {
-	data, err := os.ReadFile(fn)
-	if os.IsNotExist(err) {
-		return &state{chess.NewGame(), []int{}}, nil
-	}
+// putDownFrom is putDown, arriving over center at travelZ
+func (s *viamChessChess) putDownFrom(ctx context.Context, center r3.Vector, useZ, travelZ float64) error {
+	err := s.moveGripper(ctx, r3.Vector{center.X, center.Y, travelZ})
 	if err != nil {
-		return nil, fmt.Errorf("error reading fen (%s) %T", fn, err)
+		return err
 	}
 
-	ss := savedState{}
-	err = json.Unmarshal(data, &ss)
+	err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, useZ})
 	if err != nil {
-		return nil, fmt.Errorf("cannot unmarshal json")
+		return err
 	}
 
-	f, err := chess.FEN(ss.FEN)
+	err = s.setupGripper(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("invalid fen from (%s) (%s) %w", fn, data, err)
+		return err
 	}
-	return &state{chess.NewGame(f), ss.Graveyard}, nil
+
+	return s.moveGripper(ctx, r3.Vector{center.X, center.Y, s.conf.safeZ()})
 }
 
-func (s *viamChessChess) saveGame(ctx context.Context, theState *state) error {
-	ss := savedState{
-		FEN:       theState.game.FEN(),
-		Graveyard: theState.graveyard,
+// demonstrate picks up the piece on a square, hovers it over everywhere it can legally go, then puts it back
+func (s *viamChessChess) demonstrate(ctx context.Context, square string) error {
+	sq, err := parseSquare(square)
+	if err != nil {
+		return err
 	}
-	b, err := json.MarshalIndent(&ss, "", "  ")
+
+	theState, err := s.getGame(ctx)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(s.fenFile, b, 0666)
-}
 
-func (s *viamChessChess) pickMove(ctx context.Context, game *chess.Game) (*chess.Move, error) {
-	if s.engine == nil {
-		moves := game.ValidMoves()
-		if len(moves) == 0 {
-			return nil, fmt.Errorf("no valid moves")
+	dests := []string{}
+	for _, m := range theState.game.ValidMoves() {
+		if m.S1() == sq && !slices.Contains(dests, m.S2().String()) {
+			dests = append(dests, m.S2().String())
 		}
-		return &moves[0], nil
 	}
-
-	multiplier := 1.0
-	if s.skillAdjust < 50 {
-		multiplier = float64(s.skillAdjust) / 50.0
-		s.logger.Infof("multiplier: %v", multiplier)
-	} else if s.skillAdjust > 50 {
-		multiplier = float64(s.skillAdjust-50) * 2
-		s.logger.Infof("multiplier: %v", multiplier)
+	if len(dests) == 0 {
+		return fmt.Errorf("no legal moves from %s", square)
 	}
 
-	cmdPos := uci.CmdPosition{Position: game.Position()}
-	cmdGo := uci.CmdGo{MoveTime: time.Millisecond * time.Duration(float64(s.conf.engineMillis())*multiplier)}
-	err := s.engine.Run(cmdPos, cmdGo)
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return s.engine.SearchResults().BestMove, nil
+	home, err := s.getCenterFor(all, square, theState)
+	if err != nil {
+		return err
+	}
+
+	useZ, err := s.pickUp(ctx, square, home, s.grabAt(all, theState, square))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dests {
+		center, err := s.getCenterFor(all, d, theState)
+		if err != nil {
+			return err
+		}
+
+		err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, s.conf.safeZ()})
+		if err != nil {
+			return err
+		}
+
+		err = sleep(ctx, 500*time.Millisecond)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.putDown(ctx, home, useZ)
+}
+
+// fallenPieceCenter is the highest point of a piece lying across squares, only counting points over the board if it's calibrated
+func (s *viamChessChess) fallenPieceCenter(data viscapture.VisCapture, squares []string) (r3.Vector, error) {
+	best := r3.Vector{Z: math.Inf(-1)}
+	for _, sq := range squares {
+		o := s.findObject(data, sq)
+		if o == nil {
+			return r3.Vector{}, &PieceNotFoundError{sq}
+		}
+		o.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+			if p.Z > best.Z && (!s.conf.calibrated() || s.conf.onBoard(p)) {
+				best = p
+			}
+			return true
+		})
+	}
+	if math.IsInf(best.Z, -1) {
+		return r3.Vector{}, &PieceNotFoundError{strings.Join(squares, " ")}
+	}
+	return best, nil
+}
+
+// pieceAxis is which way a piece lying down points, from the spread of its points above the board in pcs.
+// It's a unit vector in X, Y, pointing away from the arm's base so the gripper can reach over it; false if there aren't enough points.
+func pieceAxis(pcs []pointcloud.PointCloud) (r3.Vector, bool) {
+	low := math.Inf(1)
+	for _, pc := range pcs {
+		if pc.Size() > 0 {
+			md := pc.MetaData()
+			low = min(low, md.MinZ)
+		}
+	}
+
+	points := []r3.Vector{}
+	var mean r3.Vector
+	for _, pc := range pcs {
+		pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+			if p.Z >= low+pieceClearance {
+				points = append(points, p)
+				mean = mean.Add(p)
+			}
+			return true
+		})
+	}
+	if len(points) < 2 {
+		return r3.Vector{}, false
+	}
+	mean = mean.Mul(1 / float64(len(points)))
+
+	var xx, yy, xy float64
+	for _, p := range points {
+		dx, dy := p.X-mean.X, p.Y-mean.Y
+		xx += dx * dx
+		yy += dy * dy
+		xy += dx * dy
+	}
+	angle := math.Atan2(2*xy, xx-yy) / 2
+	axis := r3.Vector{X: math.Cos(angle), Y: math.Sin(angle)}
+	if axis.X*mean.X+axis.Y*mean.Y < 0 {
+		axis = axis.Mul(-1)
+	}
+	return axis, true
+}
+
+// uprightPiece grabs a knocked over piece low, and stands it back up in the middle of its square
+func (s *viamChessChess) uprightPiece(ctx context.Context, data viscapture.VisCapture, cmd UprightCmd) error {
+	if !s.conf.KnockoverRecovery {
+		return fmt.Errorf("knockover-recovery not enabled")
+	}
+
+	squares := []string{cmd.Square}
+	if cmd.Other != "" {
+		squares = append(squares, cmd.Other)
+	}
+
+	grab, err := s.fallenPieceCenter(data, squares)
+	if err != nil {
+		return err
+	}
+
+	o := s.findObject(data, cmd.Square)
+	if o == nil {
+		return &PieceNotFoundError{cmd.Square}
+	}
+	md := o.MetaData()
+	target := md.Center()
+
+	pcs := []pointcloud.PointCloud{}
+	for _, sq := range squares {
+		pcs = append(pcs, s.findObject(data, sq))
+	}
+	axis, ok := pieceAxis(pcs)
+	if !ok {
+		return fmt.Errorf("can't tell which way the piece on %v is lying", squares)
+	}
+
+	lowZ := s.conf.lowGrabZ()
+	s.logger.Infof("uprighting piece at %v -> %s", grab, cmd.Square)
+
+	err = s.setupGripper(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.moveGripper(ctx, r3.Vector{grab.X, grab.Y, s.conf.safeZ()})
+	if err != nil {
+		return err
+	}
+
+	err = s.moveGripper(ctx, r3.Vector{grab.X, grab.Y, lowZ})
+	if err != nil {
+		return err
+	}
+
+	got, err := s.myGrab(ctx)
+	if err != nil {
+		return err
+	}
+	if !got {
+		return fmt.Errorf("couldn't grab fallen piece on %v", squares)
+	}
+
+	err = s.moveGripper(ctx, r3.Vector{grab.X, grab.Y, s.conf.safeZ()})
+	if err != nil {
+		return err
+	}
+
+	// a piece held across its body hangs upright once the gripper points along where its body was
+	sideways := &spatialmath.OrientationVectorDegrees{OX: axis.X, OY: axis.Y, Theta: s.approachTheta() + s.conf.GripperThetaOffset}
+
+	err = s.moveGripperWithOrientation(ctx, r3.Vector{target.X, target.Y, s.conf.safeZ()}, sideways)
+	if err != nil {
+		return err
+	}
+
+	err = s.moveGripperWithOrientation(ctx, r3.Vector{target.X, target.Y, s.conf.uprightPlaceZ()}, sideways)
+	if err != nil {
+		return err
+	}
+
+	err = s.setupGripper(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.moveGripperWithOrientation(ctx, r3.Vector{target.X, target.Y, s.conf.safeZ()}, sideways)
+}
+
+// validateSetup exercises every dependency, returning "ok" or the error for each
+func (s *viamChessChess) validateSetup(ctx context.Context) map[string]interface{} {
+	report := map[string]interface{}{}
+	check := func(name string, err error) {
+		if err != nil {
+			report[name] = err.Error()
+		} else {
+			report[name] = "ok"
+		}
+	}
+
+	check("pose-start", s.goToStart(ctx))
+
+	_, err := s.arm.DoCommand(ctx, map[string]interface{}{"get_gripper": true})
+	check("arm-gripper-commands", err)
+
+	err = s.gripperOpen(ctx)
+	if err == nil {
+		_, err = s.gripperGrab(ctx)
+	}
+	if err == nil {
+		err = s.gripperOpen(ctx)
+	}
+	check("gripper", err)
+
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err == nil {
+		_, err = s.wrongSquares(all, chess.NewGame().Position().Board())
+	}
+	check("piece-finder", err)
+
+	if s.conf.NoEngine {
+		report["engine"] = "no-engine set"
+	} else if s.engine == nil {
+		check("engine", fmt.Errorf("no engine"))
+	} else {
+		s.engineLock.Lock()
+		check("engine", s.engine.Run(uci.CmdIsReady))
+		s.engineLock.Unlock()
+	}
+
+	return report
+}
+
+// selfTest moves the gripper over the center of every square at safe-z, to check a new board placement
+// and that the arm can reach it all, stopping at the first square it can't get to
+func (s *viamChessChess) selfTest(ctx context.Context) (map[string]interface{}, error) {
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	reached := 0
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		center, err := s.getCenterFor(all, sq.String(), nil)
+		if err == nil {
+			err = s.moveGripper(ctx, r3.Vector{center.X, center.Y, s.conf.safeZ()})
+		}
+		if err != nil {
+			s.logger.Warnf("self test can't reach %v: %v", sq, err)
+			return map[string]interface{}{
+				"reached": reached,
+				"failed":  sq.String(),
+				"error":   err.Error(),
+			}, nil
+		}
+		reached++
+	}
+
+	return map[string]interface{}{"reached": reached}, nil
+}
+
+// park gets the arm completely out of the way so a person can get at the whole board
+func (s *viamChessChess) park(ctx context.Context) error {
+	if s.conf.ParkPosition == nil {
+		return fmt.Errorf("no park-position configured")
+	}
+
+	err := s.gripperOpen(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.rfs.GetPose(ctx, s.conf.Gripper, "world", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	p := current.Pose().Point()
+	if p.Z < s.conf.safeZ() {
+		err = s.moveGripper(ctx, r3.Vector{p.X, p.Y, s.conf.safeZ()})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.moveGripper(ctx, *s.conf.ParkPosition)
+	if err != nil {
+		return fmt.Errorf("can't reach park-position: %w", err)
+	}
+	return nil
+}
+
+func (s *viamChessChess) goToStart(ctx context.Context) error {
+	if s.dryRun(ctx) {
+		return nil
+	}
+
+	defer s.addTiming("home", time.Now())
+
+	err := s.poseStart.SetPosition(ctx, s.conf.startPosition(), nil)
+	if err != nil {
+		return err
+	}
+	err = s.gripperOpen(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the gripper has to have stopped, moveGripper uses the start pose's theta for every move
+	err = sleep(ctx, s.conf.settle())
+	if err != nil {
+		return err
+	}
+
+	s.startPose, err = s.rfs.GetPose(ctx, s.conf.Gripper, "world", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *viamChessChess) setupGripper(ctx context.Context) error {
+	return s.openGripper(ctx, s.conf.gripperOpenWidth())
+}
+
+func (s *viamChessChess) openGripper(ctx context.Context, width float64) error {
+	if s.dryRun(ctx) {
+		return nil
+	}
+	_, err := s.arm.DoCommand(ctx, map[string]interface{}{"move_gripper": width})
+	return err
+}
+
+// gripperOpen and gripperGrab are the only places the gripper itself is told to move, so dry runs never do
+func (s *viamChessChess) gripperOpen(ctx context.Context) error {
+	if s.dryRun(ctx) {
+		return nil
+	}
+	return s.gripper.Open(ctx, nil)
+}
+
+func (s *viamChessChess) gripperGrab(ctx context.Context) (bool, error) {
+	if s.dryRun(ctx) {
+		return true, nil
+	}
+	return s.gripper.Grab(ctx, nil)
+}
+
+func (s *viamChessChess) moveGripper(ctx context.Context, p r3.Vector) error {
+	return s.moveGripperWithOrientation(ctx, p, s.conf.approachOrientation(p, s.approachTheta()))
+}
+
+// approachTheta is the gripper's theta at the start pose, which every move keeps; 0 before it's been there, like in a dry run
+func (s *viamChessChess) approachTheta() float64 {
+	if s.startPose == nil {
+		return 0
+	}
+	return s.startPose.Pose().Orientation().OrientationVectorDegrees().Theta
+}
+
+// approachOrientation points the gripper down, tilting it toward far away squares the arm can't reach straight down
+func (cfg *ChessConfig) approachOrientation(p r3.Vector, theta float64) *spatialmath.OrientationVectorDegrees {
+	orientation := &spatialmath.OrientationVectorDegrees{
+		OZ:    -1,
+		Theta: theta + cfg.GripperThetaOffset,
+	}
+
+	tiltStart, tilt := cfg.tiltXStart(), cfg.tiltX()
+	if p.X > tiltStart {
+		orientation.OX = (p.X - tiltStart) * tilt
+	}
+
+	if p.Y < -300 {
+		orientation.OY = (p.Y + 300) / 300
+		orientation.OX += .2
+	}
+
+	return orientation
+}
+
+func (s *viamChessChess) moveGripperWithOrientation(ctx context.Context, p r3.Vector, orientation spatialmath.Orientation) error {
+	if s.dryRun(ctx) {
+		s.logger.Infof("dry run, not moving the gripper to %v", p)
+		return nil
+	}
+
+	defer s.addTiming("travel", time.Now())
+
+	err := s.setArmSpeed(ctx, s.conf.speedFor(p))
+	if err != nil {
+		return err
+	}
+
+	myPose := spatialmath.NewPose(p, orientation)
+
+	moveCtx, cancel := context.WithTimeout(ctx, s.conf.moveTimeout())
+	defer cancel()
+
+	_, err = s.motion.Move(moveCtx, motion.MoveReq{
+		ComponentName: s.conf.Gripper,
+		Destination:   referenceframe.NewPoseInFrame("world", myPose),
+	})
+	if err != nil {
+		if ctx.Err() == nil && moveCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("move to %v didn't finish in %v, is the arm stuck? %w", myPose, s.conf.moveTimeout(), err)
+		}
+		return fmt.Errorf("can't move to %v: %w", myPose, err)
+	}
+	return nil
+}
+
+func (cfg *ChessConfig) tiltXStart() float64 {
+	if cfg.TiltXStart == nil {
+		return 300
+	}
+	return *cfg.TiltXStart
+}
+
+func (cfg *ChessConfig) tiltX() float64 {
+	if cfg.TiltX == nil {
+		return 1.0 / 1000
+	}
+	return *cfg.TiltX
+}
+
+// speedFor is how fast to move to p, travel-speed at safe-z and place-speed below it
+func (cfg *ChessConfig) speedFor(p r3.Vector) float64 {
+	if p.Z >= cfg.safeZ() {
+		return cfg.TravelSpeed
+	}
+	return cfg.PlaceSpeed
+}
+
+// setArmSpeed only talks to the arm when the speed changes, 0 means leave it alone
+func (s *viamChessChess) setArmSpeed(ctx context.Context, speed float64) error {
+	if speed <= 0 || speed == s.armSpeed || s.dryRun(ctx) {
+		return nil
+	}
+	_, err := s.arm.DoCommand(ctx, map[string]interface{}{"set_speed": speed})
+	if err != nil {
+		return fmt.Errorf("can't set arm speed: %w", err)
+	}
+	s.armSpeed = speed
+	return nil
+}
+
+type state struct {
+	game      *chess.Game
+	graveyard []int
+	clock     *clock      // nil for untimed games
+	robot     chess.Color // NoColor to go by robot-color
+	plies     []ply       // one per move in game, for undo
+}
+
+// ply is what undo needs to put back for one move
+type ply struct {
+	Graveyard int   `json:"graveyard"`          // graveyard length after the move, only robot moves add to it
+	WhiteMs   int64 `json:"white_ms,omitempty"` // clocks before the move
+	BlackMs   int64 `json:"black_ms,omitempty"`
+}
+
+type savedState struct {
+	FEN       string `json:"fen"`
+	Graveyard []int  `json:"graveyard"`
+
+	// so the game can be replayed for undo, older files without these just have the FEN
+	StartFEN string   `json:"start_fen,omitempty"`
+	Moves    []string `json:"moves,omitempty"` // uci notation
+
+	Resigned string `json:"resigned,omitempty"` // "w" or "b" if that side resigned, the moves alone don't say
+
+	Clock *clock `json:"clock,omitempty"`
+	Robot string `json:"robot,omitempty"` // "w" or "b" with alternate-colors
+
+	Plies []ply `json:"plies,omitempty"`
+}
+
+type gameIDKey struct{}
+
+// withGameID picks which saved game getGame, saveGame and wipe use, an empty id is the default game
+func withGameID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, gameIDKey{}, id)
+}
+
+type dryRunKey struct{}
+
+// withDryRun turns on dry-run for one command, on top of the config
+func withDryRun(ctx context.Context, on bool) context.Context {
+	if !on {
+		return ctx
+	}
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// dryRun is true if the arm shouldn't actually move for the command in ctx
+func (s *viamChessChess) dryRun(ctx context.Context) bool {
+	on, _ := ctx.Value(dryRunKey{}).(bool)
+	return on || s.conf.DryRun
+}
+
+// gameFile is the state file for the game in ctx, other games are saved next to the default one
+func (s *viamChessChess) gameFile(ctx context.Context) string {
+	id, _ := ctx.Value(gameIDKey{}).(string)
+	if id == "" {
+		return s.fenFile
+	}
+	return filepath.Join(filepath.Dir(s.fenFile), fmt.Sprintf("state-%s.json", id))
+}
+
+func (s *viamChessChess) getGame(ctx context.Context) (*state, error) {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+
+	theState, err := readState(ctx, s.gameFile(ctx), s.conf.StartFEN)
+	var corrupt *CorruptGameError
+	if errors.As(err, &corrupt) {
+		// better to start over than to never play again, but not for a file we just can't get at
+		s.logger.Errorf("starting a new game: %v", err)
+		start, err := newGame(s.conf.StartFEN)
+		if err != nil {
+			return nil, err
+		}
+		theState = &state{game: start, graveyard: []int{}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s.conf.TimeControl != nil && theState.clock == nil {
+		theState.clock = newClock(s.conf.TimeControl, time.Now())
+	}
+
+	return theState, nil
+}
+
+// newGame starts from startFEN, or the standard position if that's empty
+func newGame(startFEN string) (*chess.Game, error) {
+	if startFEN == "" {
+		return chess.NewGame(), nil
+	}
+	f, err := chess.FEN(startFEN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start-fen (%s) %w", startFEN, err)
+	}
+	return chess.NewGame(f), nil
+}
+
+// checkMaterial makes sure neither side has more than it started with.
+// Promotion can change what a pawn is, but never how many pieces there are.
+func checkMaterial(board, start *chess.Board) error {
+	for _, c := range []chess.Color{chess.White, chess.Black} {
+		total, startTotal := 0, 0
+		pawns, startPawns := 0, 0
+		for sq := chess.A1; sq <= chess.H8; sq++ {
+			if p := board.Piece(sq); p.Color() == c {
+				total++
+				if p.Type() == chess.Pawn {
+					pawns++
+				}
+			}
+			if p := start.Piece(sq); p.Color() == c {
+				startTotal++
+				if p.Type() == chess.Pawn {
+					startPawns++
+				}
+			}
+		}
+		if total > startTotal {
+			return fmt.Errorf("%s has %d pieces but started with %d", c.Name(), total, startTotal)
+		}
+		if pawns > startPawns {
+			return fmt.Errorf("%s has %d pawns but started with %d", c.Name(), pawns, startPawns)
+		}
+	}
+	return nil
+}
+
+func readState(ctx context.Context, fn, startFEN string) (*state, error) {
+	data, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		game, err := newGame(startFEN)
+		if err != nil {
+			return nil, err
+		}
+		return &state{game: game, graveyard: []int{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading fen (%s) %w", fn, err)
+	}
+
+	ss := savedState{}
+	err = json.Unmarshal(data, &ss)
+	if err != nil {
+		return nil, &CorruptGameError{File: fn, Err: err}
+	}
+
+	game := replay(ss)
+	if game == nil {
+		f, err := chess.FEN(ss.FEN)
+		if err != nil {
+			return nil, &CorruptGameError{File: fn, Err: fmt.Errorf("invalid fen (%s) %w", ss.FEN, err)}
+		}
+		game = chess.NewGame(f)
+	}
+
+	if ss.Clock != nil && ss.Clock.Flagged != "" {
+		game.AddTagPair("Termination", "time forfeit")
+	}
+	switch ss.Resigned {
+	case chess.White.String():
+		game.Resign(chess.White)
+	case chess.Black.String():
+		game.Resign(chess.Black)
+	}
+	theState := &state{game: game, graveyard: ss.Graveyard, clock: ss.Clock, plies: ss.Plies}
+	switch ss.Robot {
+	case chess.White.String():
+		theState.robot = chess.White
+	case chess.Black.String():
+		theState.robot = chess.Black
+	}
+	return theState, nil
+}
+
+// resigned is the color that resigned game, "" if nobody did
+func resigned(game *chess.Game) string {
+	if game.Method() != chess.Resignation {
+		return ""
+	}
+	if game.Outcome() == chess.WhiteWon {
+		return chess.Black.String()
+	}
+	return chess.White.String()
+}
+
+// replay rebuilds the game with its history, nil if the history is missing or doesn't end at the saved FEN
+func replay(ss savedState) *chess.Game {
+	if ss.StartFEN == "" {
+		return nil
+	}
+	game, err := replayMoves(ss.StartFEN, ss.Moves)
+	if err != nil || game.FEN() != ss.FEN {
+		return nil
+	}
+	return game
+}
+
+func replayMoves(startFEN string, moves []string) (*chess.Game, error) {
+	f, err := chess.FEN(startFEN)
+	if err != nil {
+		return nil, err
+	}
+	game := chess.NewGame(f)
+	for _, m := range moves {
+		err := game.PushNotationMove(m, chess.UCINotation{}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return game, nil
+}
+
+func (s *viamChessChess) saveGame(ctx context.Context, theState *state) error {
+	ss := savedState{
+		FEN:       theState.game.FEN(),
+		Graveyard: theState.graveyard,
+		StartFEN:  theState.game.Positions()[0].String(),
+		Resigned:  resigned(theState.game),
+		Clock:     theState.clock,
+		Plies:     theState.plies,
+	}
+	if theState.robot != chess.NoColor {
+		ss.Robot = theState.robot.String()
+	}
+	for _, m := range theState.game.Moves() {
+		ss.Moves = append(ss.Moves, m.String())
+	}
+	b, err := json.MarshalIndent(&ss, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	fn := s.gameFile(ctx)
+	err = writeFileAtomic(fn, b)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pgnFile(fn), []byte(gamePGN(theState.game)))
+}
+
+// writeFileAtomic writes to a temp file and renames it into place, so readers never see half a file
+func writeFileAtomic(fn string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = multierr.Combine(err, f.Close())
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(f.Name(), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// pgnFile is where a copy of the game goes for analysis tools, next to the state file
+func pgnFile(fenFile string) string {
+	return strings.TrimSuffix(fenFile, ".json") + ".pgn"
+}
+
+// gamePGN has the result once the game is over, and the starting position if it wasn't the standard one
+func gamePGN(game *chess.Game) string {
+	claimDraw(game)
+	game.AddTagPair("Result", game.Outcome().String())
+	if start := game.Positions()[0].String(); start != chess.NewGame().FEN() {
+		game.AddTagPair("SetUp", "1")
+		game.AddTagPair("FEN", start)
+	}
+	return game.String()
+}
+
+// bookMove picks a move for the current position from the book, weighted by the book's weights
+// returns nil if the position isn't in the book
+func bookMove(book *chess.PolyglotBook, rng *rand.Rand, game *chess.Game) *chess.Move {
+	if book == nil {
+		return nil
+	}
+
+	hash, err := chess.NewZobristHasher().HashPosition(game.FEN())
+	if err != nil {
+		return nil
+	}
+
+	valid := game.ValidMoves()
+	moves := []*chess.Move{}
+	weights := []int{}
+	total := 0
+	for _, e := range book.FindMoves(chess.ZobristHashToUint64(hash)) {
+		bm := chess.DecodeMove(e.Move).ToMove()
+		for i := range valid {
+			if valid[i].String() == bm.String() {
+				moves = append(moves, &valid[i])
+				weights = append(weights, int(e.Weight)+1) // so zero weight moves still get played sometimes
+				total += int(e.Weight) + 1
+			}
+		}
+	}
+
+	if len(moves) == 0 {
+		return nil
+	}
+
+	r := rng.Intn(total)
+	for i, w := range weights {
+		if r < w {
+			return moves[i]
+		}
+		r -= w
+	}
+	return moves[len(moves)-1]
+}
+
+// pickMove chooses the next move for game, thinking for as long as the clock allows if it isn't nil
+func (s *viamChessChess) pickMove(ctx context.Context, game *chess.Game, c *clock) (*chess.Move, error) {
+	s.statsLock.Lock()
+	s.lastEval = nil
+	s.bestEval = nil
+	s.statsLock.Unlock()
+
+	// there's nothing to search, and the engine answers that with no move at all
+	if over := gameOver(game); over != nil {
+		return nil, fmt.Errorf("game is over: %v by %v", over["outcome"], over["method"])
+	}
+
+	if m := bookMove(s.book, s.rng, game); m != nil {
+		s.logger.Infof("book move: %v", m)
+		return m, nil
+	}
+
+	if s.engine == nil {
+		moves := game.ValidMoves()
+		if len(moves) == 0 {
+			return nil, fmt.Errorf("no valid moves")
+		}
+		return &moves[0], nil
+	}
+
+	s.engineLock.Lock()
+	defer s.engineLock.Unlock()
+
+	multiplier := 1.0
+	if s.skillAdjust < 50 {
+		multiplier = float64(s.skillAdjust) / 50.0
+		s.logger.Infof("multiplier: %v", multiplier)
+	} else if s.skillAdjust > 50 {
+		multiplier = float64(s.skillAdjust-50) * 2
+		s.logger.Infof("multiplier: %v", multiplier)
+	}
+
+	goCmd := s.conf.goCmd(multiplier)
+	if c != nil {
+		goCmd = s.conf.clockGoCmd(multiplier, c.moveTime(game.Position().Turn()))
+	}
+
+	if s.conf.BlunderRate > 0 && s.rng.Float64() < s.conf.BlunderRate {
+		m, err := s.blunder(game, goCmd)
+		if err == nil {
+			s.logger.Infof("blundering on purpose: %v", m)
+			return m, nil
+		}
+		s.logger.Warnf("can't blunder, playing the best move: %v", err)
+	}
+
+	cmdPos := enginePosition(game)
+	err := s.engine.Run(cmdPos, uci.CmdIsReady, goCmd)
+	if err == nil && s.engine.SearchResults().BestMove != nil {
+		return s.engineMove(), nil
+	}
+	s.logger.Warnf("engine failed, restarting it: %v", err)
+
+	err = s.restartEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.engine.Run(cmdPos, uci.CmdIsReady, goCmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.engine.SearchResults().BestMove == nil {
+		return nil, fmt.Errorf("engine didn't return a move, even after a restart")
+	}
+	return s.engineMove(), nil
+}
+
+// enginePosition is the game as its starting position plus every move since, not just the current FEN,
+// so the engine sees repetitions and its hash from the last search still lines up. UCI has no way to send
+// only the newest move, so it's the whole game each time; every search also waits for isready first,
+// so a late bestmove from the last one can't be taken as the answer.
+func enginePosition(game *chess.Game) uci.CmdPosition {
+	positions := game.Positions()
+	if len(positions) == 0 || positions[len(positions)-1].String() != game.Position().String() {
+		return uci.CmdPosition{Position: game.Position()} // not at the end of the main line, history doesn't help
+	}
+	return uci.CmdPosition{Position: positions[0], Moves: game.Moves()}
+}
+
+// blunderCandidates is how many of the engine's best moves a blunder is picked from
+const blunderCandidates = 5
+
+// blunder asks the engine for its top moves and plays one that isn't the best, callers must hold engineLock
+func (s *viamChessChess) blunder(game *chess.Game, goCmd uci.CmdGo) (*chess.Move, error) {
+	err := s.engine.Run(uci.CmdSetOption{Name: "MultiPV", Value: fmt.Sprintf("%d", blunderCandidates)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := s.engine.Run(uci.CmdSetOption{Name: "MultiPV", Value: "1"})
+		if err != nil {
+			s.logger.Warnf("can't reset MultiPV: %v", err)
+		}
+	}()
+
+	err = s.engine.Run(enginePosition(game), uci.CmdIsReady, goCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	res := s.engine.SearchResults()
+	m, score := blunderMove(res, s.rng, game)
+	if m == nil {
+		return nil, fmt.Errorf("no valid moves")
+	}
+	s.statsLock.Lock()
+	s.lastEval = score
+	s.bestEval = &res.Info.Score
+	s.statsLock.Unlock()
+	return m, nil
+}
+
+// blunderMove picks one of the engine's 2nd to nth best moves, or any legal move if it only found one.
+// score is the engine's eval of the move, nil if it was a random one.
+func blunderMove(res uci.SearchResults, rng *rand.Rand, game *chess.Game) (*chess.Move, *uci.Score) {
+	valid := game.ValidMoves()
+	if len(valid) == 0 {
+		return nil, nil
+	}
+
+	moves := []*chess.Move{}
+	scores := []*uci.Score{}
+	for n, info := range res.MultiPVInfo {
+		if n == 0 || len(info.PV) == 0 {
+			continue // the first is the best move
+		}
+		for i := range valid {
+			if valid[i].String() == info.PV[0].String() {
+				score := info.Score
+				moves = append(moves, &valid[i])
+				scores = append(scores, &score)
+			}
+		}
+	}
+
+	if len(moves) == 0 {
+		return &valid[rng.Intn(len(valid))], nil
+	}
+	i := rng.Intn(len(moves))
+	return moves[i], scores[i]
+}
+
+// engineMove is the best move from the last search, remembering its evaluation
+func (s *viamChessChess) engineMove() *chess.Move {
+	res := s.engine.SearchResults()
+	s.statsLock.Lock()
+	s.lastEval = &res.Info.Score
+	s.bestEval = s.lastEval
+	s.statsLock.Unlock()
+	return res.BestMove
+}
+
+// restartEngine replaces a dead or confused engine, callers must hold engineLock
+func (s *viamChessChess) restartEngine() error {
+	err := s.engine.Close()
+	if err != nil {
+		s.logger.Debugf("error closing old engine: %v", err)
+	}
+
+	s.statsLock.Lock()
+	s.engineRestarts++
+	s.statsLock.Unlock()
+
+	// on failure keep the dead engine, so the next move tries again rather than playing randomly
+	engine, err := startEngine(s.conf)
+	if err != nil {
+		return fmt.Errorf("can't restart engine: %w", err)
+	}
+	s.engine = engine
+	return nil
+}
+
+// analyze returns the engine's top n moves for the current game, best first
+func (s *viamChessChess) analyze(ctx context.Context, n int) ([]interface{}, error) {
+	s.engineLock.Lock()
+	defer s.engineLock.Unlock()
+
+	if s.engine == nil {
+		return nil, fmt.Errorf("no engine to analyze with")
+	}
+
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.engine.Run(uci.CmdSetOption{Name: "MultiPV", Value: fmt.Sprintf("%d", n)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := s.engine.Run(uci.CmdSetOption{Name: "MultiPV", Value: "1"})
+		if err != nil {
+			s.logger.Warnf("can't reset MultiPV: %v", err)
+		}
+	}()
+
+	err = s.engine.Run(enginePosition(theState.game), uci.CmdIsReady, s.conf.goCmd(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return candidateMoves(s.engine.SearchResults(), n), nil
+}
+
+// candidateMoves turns the engine's principal variations into something DoCommand can return
+func candidateMoves(res uci.SearchResults, n int) []interface{} {
+	ret := []interface{}{}
+	for _, info := range res.MultiPVInfo {
+		if len(ret) >= n {
+			break
+		}
+		if len(info.PV) == 0 {
+			continue
+		}
+		m := map[string]interface{}{"move": info.PV[0].String()}
+		addEval(m, info.Score)
+		ret = append(ret, m)
+	}
+	return ret
+}
 
+// addEval adds the score in centipawns, and mate in n if the engine sees one
+func addEval(m map[string]interface{}, score uci.Score) {
+	m["eval_cp"] = score.CP
+	if score.Mate != 0 {
+		m["mate_in"] = score.Mate
+	}
 }
 
-func (s *viamChessChess) makeAMove(ctx context.Context) (*chess.Move, error) {
-	err := s.goToStart(ctx)
+// claimDraw claims a threefold repetition or fifty move draw, which the chess library allows but doesn't end the game for
+func claimDraw(game *chess.Game) {
+	if game.Outcome() != chess.NoOutcome {
+		return
+	}
+	for _, m := range game.EligibleDraws() {
+		if m == chess.ThreefoldRepetition || m == chess.FiftyMoveRule {
+			err := game.Draw(m)
+			if err == nil {
+				return
+			}
+		}
+	}
+}
+
+// gameOver is the result and how the game ended, nil while it's still going
+func gameOver(game *chess.Game) map[string]interface{} {
+	claimDraw(game)
+	if game.Outcome() == chess.NoOutcome {
+		return nil
+	}
+	method := game.Method().String()
+	if lostOnTime(game) {
+		method = "Timeout"
+	}
+	return map[string]interface{}{
+		"outcome": game.Outcome().String(),
+		"method":  method,
+	}
+}
+
+// makeAMove plays one engine move on the board, over is set if that move ended the game
+func (s *viamChessChess) makeAMove(ctx context.Context) (*chess.Move, map[string]interface{}, error) {
+	s.timings = map[string]time.Duration{}
+	defer s.finishTimings(time.Now())
+
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if over := gameOver(theState.game); over != nil {
+		return nil, nil, fmt.Errorf("game is over (%v by %v), start a new_game", over["outcome"], over["method"])
+	}
+	if !s.conf.robotsTurn(theState) {
+		return nil, nil, fmt.Errorf("it's %s's turn, the robot plays %s", theState.game.Position().Turn().Name(), s.conf.robotFor(theState).Name())
+	}
+
+	s.showTurn(ctx, true)
+
+	err = s.goToStart(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't go home: %v", err)
+	}
+
+	start := time.Now()
+	m, err := s.pickMove(ctx, theState.game, theState.clock)
+	s.addTiming("engine", start)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.conf.shouldResign(s.bestEval) {
+		over, err := s.resign(ctx, theState)
+		return nil, over, err
+	}
+
+	before := theState.game.Position()
+	over, err := s.playMove(ctx, theState, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.showTurn(ctx, false)
+	s.broadcastMove(m, theState.game.FEN())
+	s.say(ctx, spokenMove(before, m, theState.game))
+	return m, over, nil
+}
+
+// showTurn sets the turn-indicator, if there is one; a broken light isn't worth stopping the game for
+func (s *viamChessChess) showTurn(ctx context.Context, robot bool) {
+	if s.turnIndicator == nil {
+		return
+	}
+	pos := uint32(0)
+	if robot {
+		pos = 1
+	}
+	err := s.turnIndicator.SetPosition(ctx, pos, nil)
+	if err != nil {
+		s.logger.Warnf("can't set turn-indicator: %v", err)
+	}
+}
+
+// say announces text through the speech service, if there is one
+func (s *viamChessChess) say(ctx context.Context, text string) {
+	if s.speech == nil {
+		return
+	}
+	_, err := s.speech.DoCommand(ctx, map[string]interface{}{"say": text})
+	if err != nil {
+		s.logger.Warnf("can't say %q: %v", text, err)
+	}
+}
+
+var pieceNames = map[chess.PieceType]string{
+	chess.King:   "king",
+	chess.Queen:  "queen",
+	chess.Rook:   "rook",
+	chess.Bishop: "bishop",
+	chess.Knight: "knight",
+	chess.Pawn:   "pawn",
+}
+
+// spokenMove is m, played from before, in words, e.g. "knight takes e5, check"; game is after the move
+func spokenMove(before *chess.Position, m *chess.Move, game *chess.Game) string {
+	var text string
+	switch {
+	case m.HasTag(chess.KingSideCastle):
+		text = "castles kingside"
+	case m.HasTag(chess.QueenSideCastle):
+		text = "castles queenside"
+	default:
+		board := before.Board()
+		verb := "to"
+		if board.Piece(m.S2()) != chess.NoPiece || m.HasTag(chess.EnPassant) {
+			verb = "takes"
+		}
+		text = fmt.Sprintf("%s %s %s", pieceNames[board.Piece(m.S1()).Type()], verb, m.S2())
+		if m.Promo() != chess.NoPieceType {
+			text += ", promotes to " + pieceNames[m.Promo()]
+		}
+	}
+
+	if game.Method() == chess.Checkmate {
+		return text + ", checkmate"
+	}
+	if inCheck(game) {
+		return text + ", check"
+	}
+	return text
+}
+
+// broadcastMove sends a move to the mqtt-broker and webhook-url if there are any, in the background
+// so a slow or missing broker doesn't hold up the game; failures are only logged
+func (s *viamChessChess) broadcastMove(m *chess.Move, fen string) {
+	if s.conf.MQTTBroker == "" && s.conf.WebhookURL == "" {
+		return
+	}
+
+	msg := map[string]interface{}{"move": m.String(), "fen": fen}
+	if s.lastEval != nil {
+		addEval(msg, *s.lastEval)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Warnf("can't encode move %v: %v", m, err)
+		return
+	}
+
+	go func() {
+		s.broadcastLock.Lock()
+		defer s.broadcastLock.Unlock()
+
+		if s.conf.MQTTBroker != "" {
+			broker := mqttBroker{URL: s.conf.MQTTBroker, Username: s.conf.MQTTUsername, Password: s.conf.MQTTPassword}
+			err := mqttPublish(s.cancelCtx, broker, "viam-chess-"+s.name.ShortName(), s.conf.MQTTTopic, payload)
+			if err != nil {
+				s.logger.Warnf("can't publish move %v: %v", m, err)
+			}
+		}
+
+		if s.conf.WebhookURL != "" {
+			err := postWebhook(s.cancelCtx, s.conf.WebhookURL, payload)
+			if err != nil {
+				s.logger.Warnf("webhook for move %v failed: %v", m, err)
+			}
+		}
+	}()
+}
+
+const webhookTimeout = 5 * time.Second
+
+// postWebhook POSTs payload as JSON, anything but a 2xx is an error
+func postWebhook(ctx context.Context, url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// resign gives up the game for the side to move, which stays over until new_game
+func (s *viamChessChess) resign(ctx context.Context, theState *state) (map[string]interface{}, error) {
+	s.logger.Infof("resigning, eval %v", *s.bestEval)
+	theState.game.Resign(theState.game.Position().Turn())
+
+	err := s.saveGame(ctx, theState)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]interface{}{
+		"outcome": "resigned",
+		"result":  theState.game.Outcome().String(),
+	}
+	addEval(ret, *s.bestEval)
+	return ret, nil
+}
+
+// startGame lets stop end the game that's starting, stopped is done once someone asks
+func (s *viamChessChess) startGame() (stopped context.Context, done func()) {
+	stopped, cancel := context.WithCancel(context.Background())
+	s.gameLock.Lock()
+	s.stopGame = cancel
+	s.gameLock.Unlock()
+
+	return stopped, func() {
+		s.gameLock.Lock()
+		s.stopGame = nil
+		s.gameLock.Unlock()
+		cancel()
+	}
+}
+
+// stop asks the game in progress to end, it doesn't wait for it to
+func (s *viamChessChess) stop() error {
+	s.gameLock.Lock()
+	defer s.gameLock.Unlock()
+	if s.stopGame == nil {
+		return fmt.Errorf("no game in progress to stop")
+	}
+	s.logger.Infof("stopping the game after this move")
+	s.stopGame()
+	return nil
+}
+
+// playGame has the engine play both sides until the game is over, stop is called, or the resource is closed.
+// With a robot-color it waits for the person's moves instead of playing them, stop ends that wait straight away.
+func (s *viamChessChess) playGame(ctx context.Context) (map[string]interface{}, error) {
+	stopped, done := s.startGame()
+	defer done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.cancelCtx.Done():
+			return nil, s.cancelCtx.Err()
+		case <-stopped.Done():
+			return map[string]interface{}{"stopped": true}, nil
+		default:
+		}
+
+		theState, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var over map[string]interface{}
+		if s.conf.robotsTurn(theState) {
+			_, over, err = s.makeAMove(ctx)
+		} else {
+			waitCtx, cancel := context.WithCancel(ctx)
+			stop := context.AfterFunc(stopped, cancel)
+			over, err = s.waitForHuman(waitCtx)
+			stop()
+			cancel()
+			if err != nil && stopped.Err() != nil {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if over == nil {
+			continue
+		}
+
+		theState, err = s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		over["pgn"] = gamePGN(theState.game)
+		return over, nil
+	}
+}
+
+// lichessGame is the game the lichess command asks for, a game id or true for defaultID, "" if it's false
+func lichessGame(v interface{}, defaultID string) (string, error) {
+	gameID := defaultID
+	switch v := v.(type) {
+	case string:
+		gameID = v
+	case bool:
+		if !v {
+			return "", nil
+		}
+	default:
+		return "", fmt.Errorf("lichess needs a game id or true, not %v", v)
+	}
+	if gameID == "" {
+		return "", fmt.Errorf("no lichess game id, pass one or set lichess-game-id")
+	}
+	return gameID, nil
+}
+
+// playLichess plays a lichess game on the board until it's over or stop is called: the opponent's moves are made by the arm,
+// and the robot's are sent back. The saved game has to be the start of the lichess game, or a new_game.
+func (s *viamChessChess) playLichess(ctx context.Context, client *lichessClient, gameID string) (map[string]interface{}, error) {
+	me, err := client.account(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("can't go home: %v", err)
+		return nil, err
+	}
+
+	stopped, done := s.startGame()
+	defer done()
+
+	// stop only hangs up on lichess, a move that's already started still finishes with ctx
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(stopped, cancel)()
+
+	robot := chess.NoColor
+	var over map[string]interface{}
+	for {
+		err := client.stream(streamCtx, gameID, func(e lichessEvent) (bool, error) {
+			if stopped.Err() != nil {
+				return true, nil
+			}
+			switch e.Type {
+			case "gameFull":
+				switch me {
+				case e.White.ID:
+					robot = chess.White
+				case e.Black.ID:
+					robot = chess.Black
+				default:
+					return false, fmt.Errorf("%s isn't playing in lichess game %s", me, gameID)
+				}
+			case "gameState":
+			default:
+				return false, nil
+			}
+
+			var err error
+			over, err = s.syncLichess(ctx, client, gameID, robot, e.state())
+			return over != nil, err
+		})
+		if over != nil {
+			return over, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if stopped.Err() != nil {
+			return map[string]interface{}{"stopped": true}, nil
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !isNetError(err) {
+			return nil, err
+		}
+
+		// lichess drops idle streams and networks come and go, the next gameFull says where things are
+		s.logger.Warnf("lost lichess game %s, reconnecting: %v", gameID, err)
+		err = sleep(ctx, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
 	}
+}
 
+// isNetError is a dropped connection rather than lichess saying no
+func isNetError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// syncLichess catches the board up with the lichess game, then moves if it's the robot's turn; over is set once the game ends
+func (s *viamChessChess) syncLichess(ctx context.Context, client *lichessClient, gameID string, robot chess.Color, st *lichessState) (map[string]interface{}, error) {
 	theState, err := s.getGame(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := s.pickMove(ctx, theState.game)
+	remote := strings.Fields(st.Moves)
+	local := theState.game.Moves()
+	if len(local) > len(remote)+1 || !lichessPrefix(local, remote) {
+		return nil, fmt.Errorf("saved game doesn't match lichess game %s, start a new_game", gameID)
+	}
+
+	if len(local) == len(remote)+1 {
+		// we played it but lichess never heard, e.g. the connection dropped
+		if theState.game.Positions()[len(local)-1].Turn() != robot {
+			return nil, fmt.Errorf("saved game is ahead of lichess game %s with the opponent's move", gameID)
+		}
+		return nil, client.move(ctx, gameID, local[len(local)-1].String())
+	}
+
+	for _, u := range remote[len(local):] {
+		m, err := parseMove(theState.game, "", u)
+		if err != nil {
+			return nil, err
+		}
+		s.logger.Infof("lichess move %v", m)
+
+		err = s.goToStart(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.playMove(ctx, theState, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// lichess keeps the real clock, ours just tells the engine how long to think
+	inc := st.WInc
+	if robot == chess.Black {
+		inc = st.BInc
+	}
+	theState.clock = &clock{WhiteMs: st.WTime, BlackMs: st.BTime, IncrementMs: inc, TurnStart: time.Now(), Lichess: true}
+	theState.robot = robot
+	err = s.saveGame(ctx, theState)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.over() {
+		return map[string]interface{}{"outcome": st.Status, "pgn": gamePGN(theState.game)}, nil
+	}
+	if theState.game.Position().Turn() != robot {
+		return nil, nil
+	}
+
+	m, over, err := s.makeAMove(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil { // resigned
+		return over, client.resign(ctx, gameID)
+	}
+	return nil, client.move(ctx, gameID, m.String())
+}
+
+// lichessPrefix is true if the shorter of local and remote is the start of the other
+func lichessPrefix(local []*chess.Move, remote []string) bool {
+	for i := range min(len(local), len(remote)) {
+		if local[i].String() != remote[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForHuman blocks until the person has made their move, however long they think
+func (s *viamChessChess) waitForHuman(ctx context.Context) (map[string]interface{}, error) {
+	for {
+		m, err := s.waitForMove(ctx, time.Minute)
+		if err == nil {
+			s.logger.Infof("human played %v", m)
+			theState, err := s.getGame(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return gameOver(theState.game), nil
+		}
+		if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+	}
+}
+
+// playMove makes m on the board and in the saved game, over is set if that ended the game
+func (s *viamChessChess) playMove(ctx context.Context, theState *state, m *chess.Move) (map[string]interface{}, error) {
+	start := time.Now()
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	s.addTiming("capture", start)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.conf.VerifyBoard {
+		err = s.verifyBoard(all, theState, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = moveProblems(all, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Promo() != chess.NoPieceType {
+		err = s.promote(ctx, all, theState, m)
+	} else {
+		err = s.movePiece(ctx, all, theState, m.S1().String(), m.S2().String(), m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.recordMove(theState, m)
+	if err != nil {
+		return nil, err
+	}
+
+	over := gameOver(theState.game)
+	if over != nil {
+		s.logger.Infof("game over: %v by %v", over["outcome"], over["method"])
+	}
+
+	err = s.saveGame(ctx, theState)
+	if err != nil {
+		return nil, err
+	}
+
+	// the move is saved either way, the arm did what it could; someone has to fix the board by hand
+	if s.conf.VerifyPlacement && !s.dryRun(ctx) {
+		err = s.verifyPlacement(ctx, theState, m)
+		if err != nil {
+			s.logger.Warnf("move %v didn't land: %v", m, err)
+			return nil, err
+		}
+	}
+
+	return over, nil
+}
+
+// verifyPlacement looks at the board after a move, from the start pose so the arm isn't in the way
+func (s *viamChessChess) verifyPlacement(ctx context.Context, theState *state, m *chess.Move) error {
+	err := s.goToStart(ctx)
+	if err != nil {
+		return err
+	}
+
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.checkPlacement(all, theState.game.Position().Board(), m)
+}
+
+// checkPlacement fails if what the camera sees isn't the board after m
+func (s *viamChessChess) checkPlacement(data viscapture.VisCapture, board *chess.Board, m *chess.Move) error {
+	if s.squareColor(data, m.S1().String()) != 0 {
+		return fmt.Errorf("%s still has a piece on it after %v", m.S1(), m)
+	}
+	if s.squareColor(data, m.S2().String()) != int(board.Piece(m.S2()).Color()) {
+		return fmt.Errorf("the %v didn't land on %s", board.Piece(m.S2()), m.S2())
+	}
+
+	wrong, err := s.wrongSquares(data, board)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("after %v the board doesn't match the game on %v", m, wrong)
+	}
+	return nil
+}
 
-	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+// parseMove finds the legal move meant by san (e.g. "Nf3") or uci (e.g. "g1f3")
+func parseMove(game *chess.Game, san, uciMove string) (*chess.Move, error) {
+	pos := game.Position()
+
+	if uciMove != "" {
+		for _, m := range game.ValidMoves() {
+			if m.String() == uciMove {
+				return &m, nil
+			}
+		}
+		return nil, fmt.Errorf("%s isn't a legal move", uciMove)
+	}
+
+	m, err := chess.AlgebraicNotation{}.Decode(pos, san)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s isn't a legal move", san)
 	}
 
-	if m.HasTag(chess.KingSideCastle) || m.HasTag(chess.QueenSideCastle) {
-		var f, t string
-		switch m.S1().String() {
-		case "e1":
-			switch m.S2().String() {
-			case "g1":
-				f = "h1"
-				t = "f1"
-			case "a1":
-				f = "a1"
-				t = "c1"
-			default:
-				return nil, fmt.Errorf("bad castle? %v", m)
-			}
-		case "e8":
-			switch m.S2().String() {
-			case "g8":
-				f = "h8"
-				t = "f8"
-			case "a8":
-				f = "a8"
-				t = "c8"
-			default:
-				return nil, fmt.Errorf("bad castle? %v", m)
+	// the library takes the first match, so "Nd2" with knights on b1 and f3 has to be caught here
+	strip := func(x string) string { return strings.TrimRight(x, "+#!?") }
+	if strip(san) != strip(chess.AlgebraicNotation{}.Encode(pos, m)) {
+		same := 0
+		for _, o := range game.ValidMoves() {
+			if o.S2() == m.S2() && o.Promo() == m.Promo() && pos.Board().Piece(o.S1()) == pos.Board().Piece(m.S1()) {
+				same++
 			}
-		default:
-			return nil, fmt.Errorf("bad castle? %v", m)
 		}
-
-		err = s.movePiece(ctx, all, nil, f, t, nil)
-		if err != nil {
-			return nil, err
+		if same > 1 {
+			return nil, fmt.Errorf("%s is ambiguous, say which piece, e.g. %s", san, chess.AlgebraicNotation{}.Encode(pos, m))
 		}
 	}
+	return m, nil
+}
 
-	if m.HasTag(chess.EnPassant) {
-		return nil, fmt.Errorf("can't handle enpassant")
+// addTiming adds the time since start to a phase of the move in progress, if there is one
+func (s *viamChessChess) addTiming(phase string, start time.Time) {
+	if s.timings != nil {
+		s.timings[phase] += time.Since(start)
 	}
+}
 
-	err = s.movePiece(ctx, all, theState, m.S1().String(), m.S2().String(), m)
-	if err != nil {
-		return nil, err
-	}
+func (s *viamChessChess) finishTimings(start time.Time) {
+	s.addTiming("total", start)
+	s.logger.Infof("move timings: %v", s.timings)
 
-	err = theState.game.Move(m, nil)
-	if err != nil {
-		return nil, err
-	}
+	s.statsLock.Lock()
+	s.lastTimings = s.timings
+	s.statsLock.Unlock()
 
-	err = s.saveGame(ctx, theState)
-	if err != nil {
-		return nil, err
+	s.timings = nil
+}
+
+// lastTimingsMillis is the breakdown of the last move in milliseconds
+func (s *viamChessChess) lastTimingsMillis() map[string]interface{} {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	ret := map[string]interface{}{}
+	for k, v := range s.lastTimings {
+		ret[k] = v.Milliseconds()
 	}
+	return ret
+}
 
-	return m, nil
+// sleep waits for d, or less if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
 }
 
 func (s *viamChessChess) myGrab(ctx context.Context) (bool, error) {
-	got, err := s.gripper.Grab(ctx, nil)
+	defer s.addTiming("grab", time.Now())
+
+	got, err := s.gripperGrab(ctx)
+	if err != nil || s.dryRun(ctx) {
+		return got, err
+	}
+
+	err = sleep(ctx, 300*time.Millisecond)
 	if err != nil {
 		return false, err
 	}
 
-	time.Sleep(300 * time.Millisecond)
-
 	res, err := s.arm.DoCommand(ctx, map[string]interface{}{"get_gripper": true})
 	if err != nil {
 		return false, err
@@ -714,7 +3764,7 @@ func (s *viamChessChess) myGrab(ctx context.Context) (bool, error) {
 
 	s.logger.Debugf("gripper res: %v", res)
 
-	if p < 20 && got {
+	if p < s.conf.grabMinWidth() && got {
 		s.logger.Warnf("grab said we got, but i think no res: %v", res)
 		return false, nil
 	}
@@ -728,7 +3778,16 @@ func (s *viamChessChess) resetBoard(ctx context.Context) error {
 		return err
 	}
 
-	theState := &resetState{theMainState.game.Position().Board(), theMainState.graveyard}
+	start, err := newGame(s.conf.StartFEN)
+	if err != nil {
+		return err
+	}
+
+	theState := &resetState{
+		board:     theMainState.game.Position().Board(),
+		graveyard: theMainState.graveyard,
+		correct:   start.Position().Board(),
+	}
 
 	for {
 		from, to, err := nextResetMove(theState)
@@ -764,95 +3823,436 @@ func (s *viamChessChess) resetBoard(ctx context.Context) error {
 }
 
 func (s *viamChessChess) wipe(ctx context.Context) error {
-	return os.Remove(s.fenFile)
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	fn := s.gameFile(ctx)
+	err := os.Remove(pgnFile(fn))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(fn)
 }
 
-func (s *viamChessChess) checkPositionForMoves(ctx context.Context) error {
-	theState, err := s.getGame(ctx)
+// setFEN replaces the saved game with a position set up by hand, the graveyard is kept
+func (s *viamChessChess) setFEN(ctx context.Context, fen string) error {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		return fmt.Errorf("invalid fen (%s) %w", fen, err)
+	}
+	game := chess.NewGame(f)
+
+	start, err := newGame(s.conf.StartFEN)
 	if err != nil {
 		return err
 	}
+	err = checkMaterial(game.Position().Board(), start.Position().Board())
+	if err != nil {
+		return fmt.Errorf("fen doesn't fit the start-fen: %w", err)
+	}
+
+	newState := &state{game: game, graveyard: []int{}}
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		s.logger.Warnf("can't read old game, starting with an empty graveyard: %v", err)
+	} else {
+		newState.graveyard = theState.graveyard
+		newState.robot = theState.robot
+	}
+
+	return s.saveGame(ctx, newState)
+}
+
+// undo takes back the last n plies.
+// Whoever puts the pieces back takes what those moves put in the graveyard back out of it,
+// and the clocks go back to what they were before the first undone move.
+// Games saved without plies just drop captured and promoted pieces off the end of the graveyard and keep the clock.
+func undo(theState *state, n int, now time.Time) (*state, error) {
+	moves := theState.game.Moves()
+	if n > len(moves) {
+		return nil, fmt.Errorf("can't undo %d moves, only %d in the game", n, len(moves))
+	}
+	k := len(moves) - n
+
+	keep := []string{}
+	for _, m := range moves[:k] {
+		keep = append(keep, m.String())
+	}
+	game, err := replayMoves(theState.game.Positions()[0].String(), keep)
+	if err != nil {
+		return nil, err
+	}
+
+	newState := &state{game: game, clock: theState.clock, robot: theState.robot}
+
+	if len(theState.plies) != len(moves) {
+		graveyard := theState.graveyard
+		for _, m := range moves[k:] {
+			if m.HasTag(chess.Capture) || m.HasTag(chess.EnPassant) {
+				graveyard = graveyard[:max(0, len(graveyard)-1)]
+			}
+			if m.Promo() != chess.NoPieceType {
+				graveyard = graveyard[:max(0, len(graveyard)-1)]
+			}
+		}
+		newState.graveyard = graveyard
+		return newState, nil
+	}
+
+	newState.plies = slices.Clone(theState.plies[:k])
+	newState.graveyard = []int{}
+	if k > 0 {
+		newState.graveyard = slices.Clone(theState.graveyard[:min(len(theState.graveyard), theState.plies[k-1].Graveyard)])
+	}
+	if theState.clock != nil && n > 0 {
+		c := *theState.clock
+		c.WhiteMs = theState.plies[k].WhiteMs
+		c.BlackMs = theState.plies[k].BlackMs
+		c.TurnStart = now
+		c.Flagged = ""
+		newState.clock = &c
+	}
+	return newState, nil
+}
+
+// startNewGame forgets the saved game and tells the engine, returns the new game
+func (s *viamChessChess) startNewGame(ctx context.Context) (*state, error) {
+	robot := chess.NoColor
+	if s.conf.AlternateColors {
+		old, err := s.getGame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		robot = s.conf.robotFor(old)
+		if len(old.game.Moves()) > 0 { // so asking twice doesn't swap back
+			robot = robot.Other()
+		}
+	}
+
+	err := s.wipe(ctx)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if s.engine != nil {
+		s.engineLock.Lock()
+		err = s.engine.Run(uci.CmdUCINewGame, uci.CmdIsReady)
+		s.engineLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if robot != chess.NoColor {
+		s.logger.Infof("robot plays %s this game", robot.Name())
+		theState.robot = robot
+		err = s.saveGame(ctx, theState)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return theState, nil
+}
+
+// checkPositionForMoves applies a move someone made on the board since the last one, nil if there wasn't one
+func (s *viamChessChess) checkPositionForMoves(ctx context.Context) (*chess.Move, error) {
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.moveFromCapture(theState, all)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, nil
+	}
+
+	return m, s.applyMove(ctx, theState, m)
+}
+
+// recordMove makes m in the game and stops the mover's clock, running out of time loses
+func (s *viamChessChess) recordMove(theState *state, m *chess.Move) error {
+	mover := theState.game.Position().Turn()
+	err := theState.game.Move(m, nil)
+	if err != nil {
+		return err
+	}
+
+	p := ply{Graveyard: len(theState.graveyard)}
+	if theState.clock != nil {
+		p.WhiteMs, p.BlackMs = theState.clock.WhiteMs, theState.clock.BlackMs
+		if theState.clock.punch(mover, time.Now()) {
+			s.logger.Infof("%s ran out of time", mover.Name())
+			flag(theState.game, mover)
+		}
+	}
+	if len(theState.plies) == len(theState.game.Moves())-1 { // older saved games have no plies to add to
+		theState.plies = append(theState.plies, p)
+	}
+	return nil
+}
+
+func (s *viamChessChess) applyMove(ctx context.Context, theState *state, m *chess.Move) error {
+	err := s.recordMove(theState, m)
 	if err != nil {
 		return err
 	}
 
-	differnces := []chess.Square{}
-	from := chess.NoSquare
-	to := chess.NoSquare
+	return s.saveGame(ctx, theState)
+}
+
+// moveFromCapture finds the legal move that gets from the game to what the camera sees, nil if nothing changed.
+// The camera only knows colors, so every legal move is played out and compared square by square,
+// that way castling, captures and en passant need no special cases, but it has to be exactly one move.
+func (s *viamChessChess) moveFromCapture(theState *state, all viscapture.VisCapture) (*chess.Move, error) {
+	pos := theState.game.Position()
+	seen := map[chess.Square]int{}
+	differences := []string{}
 
 	for sq := chess.A1; sq <= chess.H8; sq++ {
 		x := squareToString(sq)
 
-		fromState := theState.game.Position().Board().Piece(sq)
 		o := s.findObject(all, x)
+		if o == nil {
+			return nil, &PieceNotFoundError{x}
+		}
 		oc := int(o.Geometry.Label()[3] - '0')
+		seen[sq] = oc
+
+		if int(pos.Board().Piece(sq).Color()) != oc {
+			s.logger.Debugf("different %s fromState: %v o: %v", x, pos.Board().Piece(sq), o.Geometry.Label())
+			differences = append(differences, x)
+		}
+	}
+
+	if len(differences) == 0 {
+		return nil, nil
+	}
 
-		if int(fromState.Color()) != oc {
-			s.logger.Infof("differnent %s fromState: %v o: %v oc: %v", x, fromState, o.Geometry.Label(), oc)
-			differnces = append(differnces, sq)
-			if oc == 0 {
-				from = sq
-			} else if oc > 0 {
-				to = sq
+	matches := []*chess.Move{}
+	for _, m := range theState.game.ValidMoves() {
+		after := pos.Update(&m).Board()
+		same := true
+		for sq, oc := range seen {
+			if int(after.Piece(sq).Color()) != oc {
+				same = false
+				break
 			}
 		}
+		if same {
+			matches = append(matches, &m)
+		}
+	}
 
+	if len(matches) > 1 {
+		matches = promotionFromCapture(matches, all)
 	}
 
-	if len(differnces) == 0 {
-		return nil
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no legal move changes %v", differences)
+	case 1:
+		s.logger.Infof("found it: %v", matches[0].String())
+		return matches[0], nil
 	}
+	return nil, fmt.Errorf("%d legal moves change %v, can't tell which", len(matches), differences)
+}
 
-	if len(differnces) == 4 {
-		// is this a castle??
-		if squaresSame(differnces, []chess.Square{chess.E1, chess.F1, chess.G1, chess.H1}) {
-			// white king castle
-			from = chess.E1
-			to = chess.G1
-			differnces = nil
-		} else if squaresSame(differnces, []chess.Square{chess.E1, chess.A1, chess.C1, chess.D1}) {
-			// white queen castle
-			from = chess.E1
-			to = chess.C1
-			differnces = nil
-		} else if squaresSame(differnces, []chess.Square{chess.E8, chess.F8, chess.G8, chess.H8}) {
-			// black king castle
-			from = chess.E8
-			to = chess.G8
-			differnces = nil
-		} else if squaresSame(differnces, []chess.Square{chess.E8, chess.A8, chess.C8, chess.D8}) {
-			// black queen castle
-			from = chess.E8
-			to = chess.C8
-			differnces = nil
-		}
-	}
-
-	if len(differnces) != 2 && len(differnces) != 0 {
-		return fmt.Errorf("bad number of differnces (%d) : %v", len(differnces), differnces)
-	}
-
-	moves := theState.game.ValidMoves()
-	for _, m := range moves {
-		if m.S1() == from && m.S2() == to {
-			s.logger.Infof("found it: %v", m.String())
-			err = theState.game.Move(&m, nil)
+// promotionFromCapture narrows the promotions to the same square, which all look the same by color,
+// to the piece type the piece finder guessed, or a queen when it can't tell.
+func promotionFromCapture(matches []*chess.Move, all viscapture.VisCapture) []*chess.Move {
+	for _, m := range matches {
+		if m.Promo() == chess.NoPieceType || m.S2() != matches[0].S2() {
+			return matches
+		}
+	}
+
+	label := ""
+	for _, o := range all.Objects {
+		if strings.HasPrefix(o.Geometry.Label(), squareToString(matches[0].S2())) {
+			label = objectLabel(o)
+		}
+	}
+
+	want := chess.Queen
+	for _, m := range matches {
+		if strings.HasSuffix(label, "-"+strings.ToUpper(m.Promo().String())) {
+			want = m.Promo()
+		}
+	}
+
+	for _, m := range matches {
+		if m.Promo() == want {
+			return []*chess.Move{m}
+		}
+	}
+	return matches
+}
+
+// waitForMove watches the board until it settles into a position one legal move from the game.
+// Anything else, a piece picked up and put back, a half finished move, an illegal move, is ignored.
+func (s *viamChessChess) waitForMove(ctx context.Context, timeout time.Duration) (*chess.Move, error) {
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	prev := ""
+	stable := 0
+
+	for {
+		all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		sig := captureSignature(all)
+		if sig == prev {
+			stable++
+		} else {
+			stable = 1
+			prev = sig
+		}
+
+		if stable >= s.conf.settleCaptures() {
+			m, err := s.moveFromCapture(theState, all)
 			if err != nil {
-				return err
+				s.logger.Debugf("board settled but not on a legal move: %v", err)
+			} else if m != nil {
+				return m, s.applyMove(ctx, theState, m)
 			}
+		}
 
-			err = s.saveGame(ctx, theState)
-			if err != nil {
-				return err
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no move found: %w", ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// captureSignature is a string of what's on every square, used to see if the board has changed.
+// Only the square and color count, the piece type guess from the height can flicker.
+func captureSignature(all viscapture.VisCapture) string {
+	labels := []string{}
+	for _, o := range all.Objects {
+		labels = append(labels, o.Geometry.Label()[:4])
+	}
+	return strings.Join(labels, ",")
+}
+
+// verifyBoard fails if what the camera sees isn't the game, e.g. someone bumped the board between moves
+func (s *viamChessChess) verifyBoard(data viscapture.VisCapture, theState *state, m *chess.Move) error {
+	board := theState.game.Position().Board()
+	if s.squareColor(data, m.S1().String()) != int(board.Piece(m.S1()).Color()) {
+		return fmt.Errorf("%s should have the %v to move, but the camera doesn't see it", m.S1(), board.Piece(m.S1()))
+	}
+	if s.squareColor(data, m.S2().String()) != int(board.Piece(m.S2()).Color()) {
+		if board.Piece(m.S2()) == chess.NoPiece {
+			return fmt.Errorf("%s should be empty, but the camera sees a piece there", m.S2())
+		}
+		return fmt.Errorf("%s should have the %v to capture, but the camera sees something else", m.S2(), board.Piece(m.S2()))
+	}
+
+	wrong, err := s.wrongSquares(data, board)
+	if err != nil {
+		return err
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("the board doesn't match the game on %v, was it bumped?", wrong)
+	}
+	return nil
+}
+
+// moveProblems is a BoardNeedsHelpError if the piece finder flagged any square m touches
+func moveProblems(data viscapture.VisCapture, m *chess.Move) error {
+	problems, _ := data.Extra["problems"].(map[string]interface{})
+	if len(problems) == 0 {
+		return nil
+	}
+
+	plan, err := planMoves(m)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]string{}
+	for _, p := range plan {
+		for _, sq := range p {
+			if problem, ok := problems[sq]; ok {
+				found[sq] = fmt.Sprint(problem)
 			}
+		}
+	}
+	if len(found) > 0 {
+		return &BoardNeedsHelpError{found}
+	}
+	return nil
+}
 
-			return nil
+// wrongSquares returns every square where what the camera sees doesn't match the board
+func (s *viamChessChess) wrongSquares(data viscapture.VisCapture, board *chess.Board) ([]string, error) {
+	wrong := []string{}
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		x := squareToString(sq)
+
+		o := s.findObject(data, x)
+		if o == nil {
+			return nil, &PieceNotFoundError{x}
+		}
+		oc := int(o.Geometry.Label()[3] - '0')
+
+		if int(board.Piece(sq).Color()) != oc {
+			wrong = append(wrong, x)
 		}
 	}
+	return wrong, nil
+}
+
+// verifyStartingPosition makes sure a fresh game is actually set up on the board
+func (s *viamChessChess) verifyStartingPosition(ctx context.Context) error {
+	theState, err := s.getGame(ctx)
+	if err != nil {
+		return err
+	}
+
+	start, err := newGame(s.conf.StartFEN)
+	if err != nil {
+		return err
+	}
+
+	if theState.game.FEN() != start.FEN() {
+		return nil
+	}
+
+	all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+	if err != nil {
+		return err
+	}
+
+	wrong, err := s.wrongSquares(all, theState.game.Position().Board())
+	if err != nil {
+		return err
+	}
+
+	if len(wrong) > 0 {
+		return fmt.Errorf("board is not set up for a new game, wrong squares: %v", wrong)
+	}
 
-	return fmt.Errorf("no valid moves from: %v to %v found out of %d", from, to, len(moves))
+	return nil
 }
 
 func (s *viamChessChess) centerCamera(ctx context.Context) error {
@@ -864,7 +4264,10 @@ func (s *viamChessChess) centerCamera(ctx context.Context) error {
 	//pose := s.startPose.Pose()
 
 	for {
-		time.Sleep(time.Second)
+		err := sleep(ctx, time.Second)
+		if err != nil {
+			return err
+		}
 
 		all, err := s.pieceFinder.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
 		if err != nil {
@@ -907,24 +4310,3 @@ func (s *viamChessChess) centerCamera(ctx context.Context) error {
 
 	}
 }
-
-func squaresSame(a, b []chess.Square) bool {
-	if len(a) != len(b) {
-		return false
-	}
-
-	// Check that every element in a exists in b
-	for _, sq := range a {
-		found := false
-		for _, sq2 := range b {
-			if sq == sq2 {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
-	}
-	return true
-}
@@ -0,0 +1,1499 @@
+package viamchess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang/geo/r3"
+
+	toggleswitch "go.viam.com/rdk/components/switch"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/pointcloud"
+	"go.viam.com/rdk/services/vision"
+	viz "go.viam.com/rdk/vision"
+	"go.viam.com/rdk/vision/viscapture"
+	"go.viam.com/test"
+
+	"github.com/corentings/chess/v2"
+	"github.com/corentings/chess/v2/uci"
+)
+
+// fakeCapture builds what the piece finder would return for the given board
+func fakeCapture(t *testing.T, board *chess.Board) viscapture.VisCapture {
+	ret := viscapture.VisCapture{}
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		pc := pointcloud.NewBasicEmpty()
+		err := pc.Set(r3.Vector{float64(sq.File()) * 50, float64(sq.Rank()) * 50, 0}, nil)
+		test.That(t, err, test.ShouldBeNil)
+
+		label := fmt.Sprintf("%s-%d", sq.String(), int(board.Piece(sq).Color()))
+		o, err := viz.NewObjectWithLabel(pc, label, nil)
+		test.That(t, err, test.ShouldBeNil)
+		ret.Objects = append(ret.Objects, o)
+	}
+	return ret
+}
+
+func TestWrongSquares(t *testing.T) {
+	s := &viamChessChess{}
+	start := chess.NewGame().Position().Board()
+
+	wrong, err := s.wrongSquares(fakeCapture(t, start), start)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, wrong, test.ShouldBeEmpty)
+
+	game := chess.NewGame()
+	err = game.PushMove("e4", nil)
+	test.That(t, err, test.ShouldBeNil)
+
+	wrong, err = s.wrongSquares(fakeCapture(t, game.Position().Board()), start)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, wrong, test.ShouldResemble, []string{"e2", "e4"})
+}
+
+func TestVerifyBoard(t *testing.T) {
+	s := &viamChessChess{}
+	theState := &state{game: chess.NewGame(), graveyard: []int{}}
+	e4, err := parseMove(theState.game, "e4", "")
+	test.That(t, err, test.ShouldBeNil)
+
+	test.That(t, s.verifyBoard(fakeCapture(t, theState.game.Position().Board()), theState, e4), test.ShouldBeNil)
+
+	// someone already pushed the pawn
+	bumped := theState.game.Clone()
+	test.That(t, bumped.PushMove("e4", nil), test.ShouldBeNil)
+	err = s.verifyBoard(fakeCapture(t, bumped.Position().Board()), theState, e4)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "e2")
+
+	// a knight wandered off somewhere else
+	bumped = theState.game.Clone()
+	test.That(t, bumped.PushMove("Nf3", nil), test.ShouldBeNil)
+	err = s.verifyBoard(fakeCapture(t, bumped.Position().Board()), theState, e4)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "bumped")
+}
+
+func TestCheckPlacement(t *testing.T) {
+	s := &viamChessChess{}
+	game := chess.NewGame()
+	e4, err := parseMove(game, "e4", "")
+	test.That(t, err, test.ShouldBeNil)
+	before := fakeCapture(t, game.Position().Board())
+	test.That(t, game.Move(e4, nil), test.ShouldBeNil)
+	board := game.Position().Board()
+
+	test.That(t, s.checkPlacement(fakeCapture(t, board), board, e4), test.ShouldBeNil)
+
+	err = s.checkPlacement(before, board, e4)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "e2")
+
+	// dropped on the way
+	dropped := fakeCapture(t, board)
+	for i, o := range dropped.Objects {
+		if o.Geometry.Label() == "e4-1" {
+			dropped.Objects[i] = before.Objects[i]
+		}
+	}
+	err = s.checkPlacement(dropped, board, e4)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "e4")
+}
+
+func TestCalibratedSquareCenter(t *testing.T) {
+	cfg := &ChessConfig{
+		BoardA1:    &r3.Vector{X: 100, Y: -200},
+		SquareSize: 50,
+		BoardZ:     10,
+	}
+	test.That(t, cfg.calibrated(), test.ShouldBeTrue)
+
+	c := cfg.squareCenter(chess.A1)
+	test.That(t, c.X, test.ShouldAlmostEqual, 125)
+	test.That(t, c.Y, test.ShouldAlmostEqual, -175)
+	test.That(t, c.Z, test.ShouldAlmostEqual, 10)
+
+	c = cfg.squareCenter(chess.H8)
+	test.That(t, c.X, test.ShouldAlmostEqual, 475)
+	test.That(t, c.Y, test.ShouldAlmostEqual, 175)
+
+	test.That(t, cfg.onBoard(r3.Vector{X: 300, Y: 0}), test.ShouldBeTrue)
+	test.That(t, cfg.onBoard(r3.Vector{X: 300, Y: 300}), test.ShouldBeFalse)
+
+	cfg.BoardAngle = 90
+	c = cfg.squareCenter(chess.H1)
+	test.That(t, c.X, test.ShouldAlmostEqual, 75)
+	test.That(t, c.Y, test.ShouldAlmostEqual, 175)
+	test.That(t, cfg.onBoard(c), test.ShouldBeTrue)
+	test.That(t, cfg.onBoard(r3.Vector{X: 300, Y: 0}), test.ShouldBeFalse)
+}
+
+func TestMoveFromCapture(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t)}
+	theState := &state{game: chess.NewGame(), graveyard: []int{}}
+
+	m, err := s.moveFromCapture(theState, fakeCapture(t, theState.game.Position().Board()))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m, test.ShouldBeNil)
+
+	after := chess.NewGame()
+	err = after.PushMove("Nf3", nil)
+	test.That(t, err, test.ShouldBeNil)
+
+	m, err = s.moveFromCapture(theState, fakeCapture(t, after.Position().Board()))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m.String(), test.ShouldEqual, "g1f3")
+
+	// knight picked up but not put down yet
+	lifted := fakeCapture(t, theState.game.Position().Board())
+	for i, o := range lifted.Objects {
+		if o.Geometry.Label() == "g1-1" {
+			lifted.Objects[i] = fakeCapture(t, after.Position().Board()).Objects[i]
+		}
+	}
+	_, err = s.moveFromCapture(theState, lifted)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, captureSignature(lifted), test.ShouldNotEqual, captureSignature(fakeCapture(t, after.Position().Board())))
+}
+
+func TestMoveFromCaptureSpecialMoves(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t)}
+
+	for _, tc := range []struct {
+		fen  string
+		move string
+	}{
+		{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "O-O"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R b KQkq - 0 1", "O-O-O"},
+		{"4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1", "exd6"},
+		{"4k3/8/8/3p4/4P3/8/8/4K3 w - - 0 1", "exd5"},
+		{"4k3/P7/8/8/8/8/8/4K3 w - - 0 1", "a8=Q"},
+	} {
+		game, err := newGame(tc.fen)
+		test.That(t, err, test.ShouldBeNil)
+		theState := &state{game: game, graveyard: []int{}}
+
+		after, err := newGame(tc.fen)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, after.PushMove(tc.move, nil), test.ShouldBeNil)
+		want := after.Moves()[0].String()
+
+		m, err := s.moveFromCapture(theState, fakeCapture(t, after.Position().Board()))
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, m.String(), test.ShouldEqual, want)
+	}
+}
+
+func TestPromotionFromCapture(t *testing.T) {
+	game, err := newGame("4k3/P7/8/8/8/8/8/4K3 w - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+
+	promos := []*chess.Move{}
+	for _, m := range game.ValidMoves() {
+		if m.Promo() != chess.NoPieceType {
+			promos = append(promos, &m)
+		}
+	}
+	test.That(t, len(promos), test.ShouldEqual, 4)
+
+	after := game.Clone()
+	test.That(t, after.PushMove("a8=N", nil), test.ShouldBeNil)
+	all := fakeCapture(t, after.Position().Board())
+
+	got := promotionFromCapture(promos, all)
+	test.That(t, len(got), test.ShouldEqual, 1)
+	test.That(t, got[0].Promo(), test.ShouldEqual, chess.Queen)
+
+	for i, o := range all.Objects {
+		if o.Geometry.Label() == "a8-1" {
+			all.Objects[i], err = viz.NewObjectWithLabel(o.PointCloud, "a8-1-N@0.42", nil)
+			test.That(t, err, test.ShouldBeNil)
+		}
+	}
+	got = promotionFromCapture(promos, all)
+	test.That(t, len(got), test.ShouldEqual, 1)
+	test.That(t, got[0].Promo(), test.ShouldEqual, chess.Knight)
+}
+
+func TestGrabFor(t *testing.T) {
+	cfg := &ChessConfig{
+		GrabBlack: &GrabConfig{ZOffset: -5, OpenWidth: 500},
+		GrabWhite: &GrabConfig{ZOffset: 3},
+	}
+
+	test.That(t, cfg.grabFor(0), test.ShouldResemble, GrabConfig{OpenWidth: defaultOpenWidth})
+	test.That(t, cfg.grabFor(1), test.ShouldResemble, GrabConfig{ZOffset: 3, OpenWidth: defaultOpenWidth})
+	test.That(t, cfg.grabFor(2), test.ShouldResemble, GrabConfig{ZOffset: -5, OpenWidth: 500})
+
+	cfg.GripperOpenWidth = 80
+	test.That(t, cfg.grabFor(1), test.ShouldResemble, GrabConfig{ZOffset: 3, OpenWidth: 80})
+	test.That(t, cfg.grabFor(2), test.ShouldResemble, GrabConfig{ZOffset: -5, OpenWidth: 500})
+}
+
+func TestGrabAt(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{
+		GrabWhite:    &GrabConfig{ZOffset: 3},
+		GrabZOffsets: map[string]float64{"k": 10},
+	}}
+	theState := &state{game: chess.NewGame()}
+	data := boardCapture(t, "e1", "d1")
+
+	// demonstrate and real moves both grab a king higher than a queen
+	test.That(t, s.grabAt(data, theState, "e1").ZOffset, test.ShouldEqual, 13)
+	test.That(t, s.grabAt(data, theState, "d1").ZOffset, test.ShouldEqual, 3)
+}
+
+func TestPlanMovesCastle(t *testing.T) {
+	f, err := chess.FEN("r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R w KQkq - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	game := chess.NewGame(f)
+
+	plans := map[string][][2]string{}
+	for _, m := range game.ValidMoves() {
+		if m.S1() != chess.E1 {
+			continue
+		}
+		p, err := planMoves(&m)
+		test.That(t, err, test.ShouldBeNil)
+		plans[m.String()] = p
+	}
+
+	test.That(t, plans["e1g1"], test.ShouldResemble, [][2]string{{"e1", "g1"}, {"h1", "f1"}})
+	test.That(t, plans["e1c1"], test.ShouldResemble, [][2]string{{"e1", "c1"}, {"a1", "d1"}})
+	test.That(t, plans["e1f1"], test.ShouldResemble, [][2]string{{"e1", "f1"}})
+
+	f, err = chess.FEN("r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R b KQkq - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	game = chess.NewGame(f)
+
+	for _, m := range game.ValidMoves() {
+		switch m.String() {
+		case "e8g8":
+			p, err := planMoves(&m)
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, p, test.ShouldResemble, [][2]string{{"e8", "g8"}, {"h8", "f8"}})
+		case "e8c8":
+			p, err := planMoves(&m)
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, p, test.ShouldResemble, [][2]string{{"e8", "c8"}, {"a8", "d8"}})
+		}
+	}
+}
+
+func TestMoveProblems(t *testing.T) {
+	f, err := chess.FEN("r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R w KQkq - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	game := chess.NewGame(f)
+	castle, err := parseMove(game, "", "e1g1")
+	test.That(t, err, test.ShouldBeNil)
+
+	data := viscapture.VisCapture{Extra: map[string]interface{}{"problems": map[string]interface{}{}}}
+	test.That(t, moveProblems(data, castle), test.ShouldBeNil)
+
+	// a toppled piece somewhere else doesn't stop the move
+	data.Extra["problems"] = map[string]interface{}{"a2": "toppled"}
+	test.That(t, moveProblems(data, castle), test.ShouldBeNil)
+
+	// the rook is part of castling too
+	data.Extra["problems"] = map[string]interface{}{"a2": "toppled", "h1": "off-grid"}
+	err = moveProblems(data, castle)
+	var help *BoardNeedsHelpError
+	test.That(t, errors.As(err, &help), test.ShouldBeTrue)
+	test.That(t, help.Problems, test.ShouldResemble, map[string]string{"h1": "off-grid"})
+	test.That(t, err.Error(), test.ShouldEqual, "board needs a hand before moving: h1 off-grid")
+}
+
+func TestReserveKey(t *testing.T) {
+	test.That(t, reserveKey(chess.WhiteQueen), test.ShouldEqual, "Q")
+	test.That(t, reserveKey(chess.WhiteKnight), test.ShouldEqual, "N")
+	test.That(t, reserveKey(chess.BlackRook), test.ShouldEqual, "r")
+	test.That(t, reserveKey(chess.NewPiece(chess.Bishop, chess.Black)), test.ShouldEqual, "b")
+}
+
+func TestPlanMovesEnPassant(t *testing.T) {
+	// black just played d7d5, white's e5 pawn can take it en passant
+	f, err := chess.FEN("rnbqkbnr/ppp1pppp/8/3pP3/8/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 3")
+	test.That(t, err, test.ShouldBeNil)
+	game := chess.NewGame(f)
+
+	var ep *chess.Move
+	for _, m := range game.ValidMoves() {
+		if m.HasTag(chess.EnPassant) {
+			ep = &m
+		}
+	}
+	test.That(t, ep, test.ShouldNotBeNil)
+	test.That(t, ep.String(), test.ShouldEqual, "e5d6")
+
+	plan, err := planMoves(ep)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, plan, test.ShouldResemble, [][2]string{{"d5", "-"}, {"e5", "d6"}})
+
+	err = game.Move(ep, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, game.FEN(), test.ShouldEqual, "rnbqkbnr/ppp1pppp/3P4/8/8/8/PPPP1PPP/RNBQKBNR b KQkq - 0 3")
+}
+
+func TestEngineOptions(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.engineOptions(), test.ShouldBeEmpty)
+
+	skill := 0
+	cfg.SkillLevel = &skill
+	cfg.UCILimitStrength = true
+	cfg.UCIElo = 1400
+
+	strs := []string{}
+	for _, c := range cfg.engineOptions() {
+		strs = append(strs, c.String())
+	}
+	test.That(t, strs, test.ShouldResemble, []string{
+		"setoption name Skill Level value 0",
+		"setoption name UCI_LimitStrength value true",
+		"setoption name UCI_Elo value 1400",
+	})
+
+	skill = 21
+	cfg.PieceFinder, cfg.Arm, cfg.Gripper, cfg.PoseStart = "a", "b", "c", "d"
+	_, _, err := cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestGoCmd(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.goCmd(1).String(), test.ShouldEqual, "go movetime 100")
+	test.That(t, cfg.goCmd(.5).String(), test.ShouldEqual, "go movetime 50")
+
+	cfg.EngineDepth = 12
+	test.That(t, cfg.goCmd(1).String(), test.ShouldEqual, "go depth 12")
+
+	cfg.EngineMillis = 2000
+	test.That(t, cfg.goCmd(1).String(), test.ShouldEqual, "go depth 12 movetime 2000")
+
+	test.That(t, cfg.clockGoCmd(1, 5*time.Second).String(), test.ShouldEqual, "go depth 12 movetime 5000")
+	test.That(t, cfg.clockGoCmd(.5, 5*time.Second).String(), test.ShouldEqual, "go depth 12 movetime 2500")
+	test.That(t, cfg.clockGoCmd(3, 5*time.Second).String(), test.ShouldEqual, "go depth 12 movetime 5000")
+
+	cfg.EngineDepth = 0
+	test.That(t, cfg.clockGoCmd(1, 5*time.Second).String(), test.ShouldEqual, "go movetime 5000")
+}
+
+func TestStartEngineMissing(t *testing.T) {
+	_, err := startEngine(&ChessConfig{Engine: "/nonexistent/stockfish"})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "/nonexistent/stockfish")
+}
+
+func TestCandidateMoves(t *testing.T) {
+	lines := []string{
+		"info depth 10 multipv 1 score cp 35 pv e2e4 e7e5",
+		"info depth 10 multipv 2 score cp 20 pv d2d4",
+		"info depth 10 multipv 3 score mate 3 pv g1f3",
+	}
+	res := uci.SearchResults{}
+	for _, l := range lines {
+		info := uci.Info{}
+		err := info.UnmarshalText([]byte(l))
+		test.That(t, err, test.ShouldBeNil)
+		res.MultiPVInfo = append(res.MultiPVInfo, info)
+	}
+
+	moves := candidateMoves(res, 2)
+	test.That(t, moves, test.ShouldResemble, []interface{}{
+		map[string]interface{}{"move": "e2e4", "eval_cp": 35},
+		map[string]interface{}{"move": "d2d4", "eval_cp": 20},
+	})
+
+	moves = candidateMoves(res, 5)
+	test.That(t, len(moves), test.ShouldEqual, 3)
+	test.That(t, moves[2], test.ShouldResemble, map[string]interface{}{"move": "g1f3", "eval_cp": 0, "mate_in": 3})
+}
+
+func TestBookMove(t *testing.T) {
+	game := chess.NewGame()
+	rng := rand.New(rand.NewSource(1))
+
+	test.That(t, bookMove(nil, rng, game), test.ShouldBeNil)
+
+	byName := map[string]chess.Move{}
+	for _, m := range game.ValidMoves() {
+		byName[m.String()] = m
+	}
+
+	hash, err := chess.NewZobristHasher().HashPosition(game.FEN())
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, chess.ZobristHashToUint64(hash), test.ShouldEqual, uint64(0x463b96181691fc9c))
+
+	book := chess.NewPolyglotBookFromMap(map[uint64][]chess.MoveWithWeight{
+		chess.ZobristHashToUint64(hash): {
+			{Move: byName["e2e4"], Weight: 1000},
+			{Move: byName["d2d4"], Weight: 0},
+		},
+	})
+
+	counts := map[string]int{}
+	for range 100 {
+		m := bookMove(book, rng, game)
+		test.That(t, m, test.ShouldNotBeNil)
+		counts[m.String()]++
+	}
+	test.That(t, counts["e2e4"], test.ShouldBeGreaterThan, 90)
+	test.That(t, counts["e2e4"]+counts["d2d4"], test.ShouldEqual, 100)
+
+	err = game.PushMove("Nf3", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, bookMove(book, rng, game), test.ShouldBeNil)
+}
+
+func TestSetFEN(t *testing.T) {
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{},
+		fenFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	ctx := context.Background()
+
+	err := s.setFEN(ctx, "not a fen")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// nine white pawns is more than anyone starts with
+	err = s.setFEN(ctx, "4k3/8/8/8/8/8/PPPPPPPP/P3K3 w - - 0 1")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	kqk := "4k3/8/8/8/8/8/8/3QK3 w - - 0 1"
+	err = s.setFEN(ctx, kqk)
+	test.That(t, err, test.ShouldBeNil)
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.game.FEN(), test.ShouldEqual, kqk)
+}
+
+func TestGameState(t *testing.T) {
+	game := chess.NewGame()
+	st := gameState(game)
+	test.That(t, st["turn"], test.ShouldEqual, "white")
+	test.That(t, st["check"], test.ShouldBeFalse)
+	test.That(t, st["outcome"], test.ShouldEqual, "*")
+	test.That(t, st["move_number"], test.ShouldEqual, "1")
+
+	for _, m := range []string{"e4", "f5", "Qh5+"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	test.That(t, gameState(game)["check"], test.ShouldBeTrue)
+
+	replayed, err := replayMoves(chess.NewGame().FEN(), []string{"e2e4", "f7f5", "d1h5"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameState(replayed)["check"], test.ShouldBeTrue)
+
+	// reload from the FEN the way getGame does, so there's no move history to lean on
+	f, err := chess.FEN(game.FEN())
+	test.That(t, err, test.ShouldBeNil)
+	st = gameState(chess.NewGame(f))
+	test.That(t, st["turn"], test.ShouldEqual, "black")
+	test.That(t, st["check"], test.ShouldBeTrue)
+	test.That(t, st["outcome"], test.ShouldEqual, "*")
+	test.That(t, st["move_number"], test.ShouldEqual, "2")
+
+	game = chess.NewGame()
+	for _, m := range []string{"f3", "e5", "g4", "Qh4#"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	st = gameState(game)
+	test.That(t, st["check"], test.ShouldBeTrue)
+	test.That(t, st["outcome"], test.ShouldEqual, "0-1")
+	test.That(t, st["method"], test.ShouldEqual, "Checkmate")
+}
+
+func TestLegalMoves(t *testing.T) {
+	game := chess.NewGame()
+
+	all, err := legalMoves(game, "")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(all), test.ShouldEqual, 20)
+
+	moves, err := legalMoves(game, "g1")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, moves, test.ShouldHaveLength, 2)
+	test.That(t, moves, test.ShouldContain, "g1f3")
+	test.That(t, moves, test.ShouldContain, "g1h3")
+
+	_, err = legalMoves(game, "z9")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	f, err := chess.FEN("4k3/1P6/8/8/8/8/8/4K2R w K - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	game = chess.NewGame(f)
+
+	moves, err = legalMoves(game, "e1")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, moves, test.ShouldContain, "e1g1")
+
+	moves, err = legalMoves(game, "b7")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, moves, test.ShouldContain, "b7b8q")
+	test.That(t, moves, test.ShouldContain, "b7b8n")
+}
+
+func TestUndo(t *testing.T) {
+	game := chess.NewGame()
+	for _, m := range []string{"e4", "d5", "exd5", "Qxd5"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	theState := &state{game: game, graveyard: []int{int(chess.BlackPawn), int(chess.WhitePawn)}}
+
+	undone, err := undo(theState, 1, time.Now())
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, undone.game.FEN(), test.ShouldEqual, "rnbqkbnr/ppp1pppp/8/3P4/8/8/PPPP1PPP/RNBQKBNR b KQkq - 0 2")
+	test.That(t, undone.graveyard, test.ShouldResemble, []int{int(chess.BlackPawn)})
+	test.That(t, undone.game.Moves(), test.ShouldHaveLength, 3)
+
+	undone, err = undo(theState, 4, time.Now())
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, undone.game.FEN(), test.ShouldEqual, chess.NewGame().FEN())
+	test.That(t, undone.graveyard, test.ShouldBeEmpty)
+
+	_, err = undo(theState, 5, time.Now())
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestUndoHumanCapture(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t)}
+	start := time.Now().Add(-time.Minute)
+	theState := &state{
+		game:      chess.NewGame(),
+		graveyard: []int{},
+		clock:     &clock{WhiteMs: 60000, BlackMs: 60000, TurnStart: start},
+	}
+
+	// the robot plays white and puts what it takes in the graveyard, the human's captures stay off to the side
+	for _, san := range []string{"e4", "d5", "exd5", "Qxd5"} {
+		m, err := parseMove(theState.game, san, "")
+		test.That(t, err, test.ShouldBeNil)
+		if san == "exd5" {
+			theState.graveyard = append(theState.graveyard, int(chess.BlackPawn))
+		}
+		test.That(t, s.recordMove(theState, m), test.ShouldBeNil)
+	}
+	test.That(t, theState.plies, test.ShouldHaveLength, 4)
+
+	now := time.Now()
+	undone, err := undo(theState, 1, now)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, undone.graveyard, test.ShouldResemble, []int{int(chess.BlackPawn)})
+	test.That(t, undone.plies, test.ShouldHaveLength, 3)
+	test.That(t, undone.clock.BlackMs, test.ShouldEqual, theState.plies[3].BlackMs)
+	test.That(t, undone.clock.TurnStart, test.ShouldEqual, now)
+
+	undone, err = undo(theState, 2, now)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, undone.graveyard, test.ShouldBeEmpty)
+	test.That(t, undone.clock.WhiteMs, test.ShouldEqual, theState.plies[2].WhiteMs)
+	test.That(t, theState.graveyard, test.ShouldHaveLength, 1)
+
+	undone, err = undo(theState, 4, now)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, undone.clock.WhiteMs, test.ShouldEqual, int64(60000))
+	test.That(t, undone.clock.BlackMs, test.ShouldEqual, int64(60000))
+}
+
+func TestSaveKeepsHistory(t *testing.T) {
+	s := &viamChessChess{
+		conf:    &ChessConfig{},
+		fenFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	ctx := context.Background()
+
+	game := chess.NewGame()
+	for _, m := range []string{"e4", "e5", "Nf3"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	err := s.saveGame(ctx, &state{game: game, graveyard: []int{}})
+	test.That(t, err, test.ShouldBeNil)
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.game.FEN(), test.ShouldEqual, game.FEN())
+	test.That(t, theState.game.Moves(), test.ShouldHaveLength, 3)
+}
+
+func TestSaveKeepsResignation(t *testing.T) {
+	s := &viamChessChess{
+		conf:    &ChessConfig{},
+		fenFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	ctx := context.Background()
+
+	game := chess.NewGame()
+	test.That(t, game.PushMove("e4", nil), test.ShouldBeNil)
+	game.Resign(chess.Black)
+	err := s.saveGame(ctx, &state{game: game, graveyard: []int{}})
+	test.That(t, err, test.ShouldBeNil)
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(theState.game), test.ShouldResemble, map[string]interface{}{"outcome": "1-0", "method": "Resignation"})
+	test.That(t, gamePGN(theState.game), test.ShouldContainSubstring, `[Result "1-0"]`)
+}
+
+func TestShouldResign(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.shouldResign(&uci.Score{CP: -5000}), test.ShouldBeFalse)
+
+	cfg.ResignThresholdCp = 800
+	test.That(t, cfg.shouldResign(nil), test.ShouldBeFalse)
+	test.That(t, cfg.shouldResign(&uci.Score{CP: -799}), test.ShouldBeFalse)
+	test.That(t, cfg.shouldResign(&uci.Score{CP: -800}), test.ShouldBeTrue)
+	test.That(t, cfg.shouldResign(&uci.Score{CP: 900}), test.ShouldBeFalse)
+	test.That(t, cfg.shouldResign(&uci.Score{Mate: -3}), test.ShouldBeTrue)
+	test.That(t, cfg.shouldResign(&uci.Score{Mate: 2}), test.ShouldBeFalse)
+}
+
+func TestGamePGN(t *testing.T) {
+	game := chess.NewGame()
+	for _, m := range []string{"f3", "e5", "g4", "Qh4#"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	pgn := gamePGN(game)
+	test.That(t, pgn, test.ShouldContainSubstring, `[Result "0-1"]`)
+	test.That(t, pgn, test.ShouldContainSubstring, "1. f3 e5 2. g4 Qh4#")
+	test.That(t, pgn, test.ShouldNotContainSubstring, "FEN")
+
+	f, err := chess.FEN("4k3/8/8/8/8/8/8/3QK3 w - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	game = chess.NewGame(f)
+	test.That(t, game.PushMove("Qd7+", nil), test.ShouldBeNil)
+	pgn = gamePGN(game)
+	test.That(t, pgn, test.ShouldContainSubstring, `[Result "*"]`)
+	test.That(t, pgn, test.ShouldContainSubstring, `[FEN "4k3/8/8/8/8/8/8/3QK3 w - - 0 1"]`)
+
+	test.That(t, pgnFile("/data/state.json"), test.ShouldEqual, "/data/state.pgn")
+}
+
+func TestGameOver(t *testing.T) {
+	game := chess.NewGame()
+	test.That(t, gameOver(game), test.ShouldBeNil)
+
+	for _, m := range []string{"f3", "e5", "g4", "Qh4#"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	test.That(t, gameOver(game), test.ShouldResemble, map[string]interface{}{"outcome": "0-1", "method": "Checkmate"})
+
+	f, err := chess.FEN("7k/5Q2/6K1/8/8/8/8/8 b - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(chess.NewGame(f))["method"], test.ShouldEqual, "Stalemate")
+
+	f, err = chess.FEN("7k/8/6K1/8/8/8/8/8 b - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(chess.NewGame(f))["method"], test.ShouldEqual, "InsufficientMaterial")
+
+	f, err = chess.FEN("7k/8/6K1/8/8/8/8/R7 b - - 100 80")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(chess.NewGame(f)), test.ShouldResemble, map[string]interface{}{"outcome": "1/2-1/2", "method": "FiftyMoveRule"})
+
+	game = chess.NewGame()
+	for range 2 {
+		for _, m := range []string{"Nf3", "Nf6", "Ng1", "Ng8"} {
+			test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+		}
+	}
+	test.That(t, gameOver(game)["method"], test.ShouldEqual, "ThreefoldRepetition")
+}
+
+func TestUnreadableSaveIsAnError(t *testing.T) {
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{},
+		fenFile: t.TempDir(), // a directory, so reading it fails without it being corrupt
+	}
+
+	_, err := s.getGame(context.Background())
+	test.That(t, err, test.ShouldNotBeNil)
+	var corrupt *CorruptGameError
+	test.That(t, errors.As(err, &corrupt), test.ShouldBeFalse)
+}
+
+func TestCorruptSaveStartsOver(t *testing.T) {
+	dir := t.TempDir()
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{},
+		fenFile: filepath.Join(dir, "state.json"),
+	}
+	ctx := context.Background()
+
+	err := os.WriteFile(s.fenFile, []byte(`{"fen": "rnbqkbnr/pppp`), 0666)
+	test.That(t, err, test.ShouldBeNil)
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.game.FEN(), test.ShouldEqual, chess.NewGame().FEN())
+
+	test.That(t, theState.game.PushMove("e4", nil), test.ShouldBeNil)
+	err = s.saveGame(ctx, theState)
+	test.That(t, err, test.ShouldBeNil)
+
+	files, err := os.ReadDir(dir)
+	test.That(t, err, test.ShouldBeNil)
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	test.That(t, names, test.ShouldResemble, []string{"state.json", "state.pgn"})
+}
+
+func TestStateFile(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", "/data/module")
+	test.That(t, (&ChessConfig{}).stateFile(), test.ShouldEqual, "/data/module/state.json")
+	test.That(t, (&ChessConfig{StateFile: "/tmp/board2.json"}).stateFile(), test.ShouldEqual, "/tmp/board2.json")
+}
+
+func TestGameID(t *testing.T) {
+	dir := t.TempDir()
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{},
+		fenFile: filepath.Join(dir, "state.json"),
+	}
+	ctx := context.Background()
+	other := withGameID(ctx, "board2")
+
+	test.That(t, s.gameFile(ctx), test.ShouldEqual, filepath.Join(dir, "state.json"))
+	test.That(t, s.gameFile(other), test.ShouldEqual, filepath.Join(dir, "state-board2.json"))
+
+	err := s.setFEN(other, "4k3/8/8/8/8/8/8/3QK3 w - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.game.FEN(), test.ShouldEqual, chess.NewGame().FEN())
+
+	theState, err = s.getGame(other)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.game.FEN(), test.ShouldEqual, "4k3/8/8/8/8/8/8/3QK3 w - - 0 1")
+
+	_, err = s.DoCommand(ctx, map[string]interface{}{"state": true, "game_id": "../x"})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestParseMove(t *testing.T) {
+	game := chess.NewGame()
+
+	m, err := parseMove(game, "Nf3", "")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m.String(), test.ShouldEqual, "g1f3")
+
+	m, err = parseMove(game, "", "e2e4")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m.String(), test.ShouldEqual, "e2e4")
+
+	_, err = parseMove(game, "Ke2", "")
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = parseMove(game, "", "e2e5")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// knights on b1 and f3 can both go to d2
+	for _, x := range []string{"Nf3", "e6", "d3", "e5"} {
+		test.That(t, game.PushMove(x, nil), test.ShouldBeNil)
+	}
+	_, err = parseMove(game, "Nd2", "")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	m, err = parseMove(game, "Nbd2", "")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m.String(), test.ShouldEqual, "b1d2")
+}
+
+func TestPieceZOffset(t *testing.T) {
+	cfg := &ChessConfig{}
+	theState := &state{game: chess.NewGame(), graveyard: []int{}}
+	test.That(t, cfg.pieceZOffset(theState, "e1"), test.ShouldEqual, 0)
+
+	cfg.GrabZOffsets = map[string]float64{"k": 20, "p": -3}
+	test.That(t, cfg.pieceZOffset(theState, "e1"), test.ShouldEqual, 20)
+	test.That(t, cfg.pieceZOffset(theState, "e8"), test.ShouldEqual, 20)
+	test.That(t, cfg.pieceZOffset(theState, "d7"), test.ShouldEqual, -3)
+	test.That(t, cfg.pieceZOffset(theState, "d1"), test.ShouldEqual, 0)
+	test.That(t, cfg.pieceZOffset(theState, "e4"), test.ShouldEqual, 0)
+	test.That(t, cfg.pieceZOffset(theState, "-"), test.ShouldEqual, 0)
+	test.That(t, cfg.pieceZOffset(nil, "e1"), test.ShouldEqual, 0)
+}
+
+func TestSpeedFor(t *testing.T) {
+	cfg := &ChessConfig{TravelSpeed: 60, PlaceSpeed: 20}
+	test.That(t, cfg.speedFor(r3.Vector{X: 300, Z: defaultSafeZ}), test.ShouldEqual, 60)
+	test.That(t, cfg.speedFor(r3.Vector{X: 300, Z: 40}), test.ShouldEqual, 20)
+
+	cfg.SafeZ = 250
+	test.That(t, cfg.speedFor(r3.Vector{X: 300, Z: defaultSafeZ}), test.ShouldEqual, 20)
+}
+
+func TestApproachOrientation(t *testing.T) {
+	cfg := &ChessConfig{}
+	o := cfg.approachOrientation(r3.Vector{X: 200}, 90)
+	test.That(t, o.OX, test.ShouldEqual, 0)
+	test.That(t, o.Theta, test.ShouldEqual, 90)
+
+	o = cfg.approachOrientation(r3.Vector{X: 500}, 90)
+	test.That(t, o.OX, test.ShouldAlmostEqual, .2)
+
+	start, tilt := 400.0, 0.0
+	cfg = &ChessConfig{GripperThetaOffset: -15, TiltXStart: &start, TiltX: &tilt}
+	o = cfg.approachOrientation(r3.Vector{X: 500}, 90)
+	test.That(t, o.OX, test.ShouldEqual, 0)
+	test.That(t, o.Theta, test.ShouldEqual, 75)
+}
+
+func TestCapturePositions(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{
+		CapturePositions: []r3.Vector{{X: 400, Y: -400, Z: 60}, {X: 450, Y: -400, Z: 60}},
+	}}
+	theState := &state{game: chess.NewGame(), graveyard: []int{}}
+
+	p, err := s.getCenterFor(viscapture.VisCapture{}, "-", theState)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, p, test.ShouldResemble, r3.Vector{X: 400, Y: -400, Z: 60})
+
+	theState.graveyard = append(theState.graveyard, int(chess.BlackPawn))
+	p, err = s.getCenterFor(viscapture.VisCapture{}, "-", theState)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, p, test.ShouldResemble, r3.Vector{X: 450, Y: -400, Z: 60})
+
+	theState.graveyard = append(theState.graveyard, int(chess.BlackPawn))
+	_, err = s.getCenterFor(viscapture.VisCapture{}, "-", theState)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// a manual move has no game, it goes in the first slot
+	p, err = s.getCenterFor(viscapture.VisCapture{}, "-", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, p, test.ShouldResemble, r3.Vector{X: 400, Y: -400, Z: 60})
+}
+
+func TestTravelZ(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{SafeZ: 10, CollisionAwareTravel: true}}
+	data := fakeCapture(t, chess.NewGame().Position().Board())
+
+	// the knight has to clear the pawns on f2 and g2, and its own bottom hangs 30 below the gripper
+	z, err := s.travelZ(data, "g1", "f3", 30)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, z, test.ShouldAlmostEqual, 50)
+
+	// nothing in the way
+	z, err = s.travelZ(data, "e2", "e4", 30)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, z, test.ShouldEqual, 10)
+
+	// not a square, just use safe-z
+	z, err = s.travelZ(data, "e7", "-", 30)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, z, test.ShouldEqual, 10)
+
+	// every square between is full, so nothing says where the board is
+	_, err = s.travelZ(data, "a1", "b2", 30)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	s.conf.BoardZ = 5
+	_, err = s.travelZ(data, "a1", "b2", 30)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+// tiltedSquare is what a camera off to the side sees in a square's image box: the board shifted away from the camera,
+// the piece standing at (100, 100), and the side of the neighbor's piece
+func tiltedSquare(t *testing.T, piece bool) pointcloud.PointCloud {
+	pc := pointcloud.NewBasicEmpty()
+	set := func(x, y, z float64) {
+		test.That(t, pc.Set(r3.Vector{x, y, z}, nil), test.ShouldBeNil)
+	}
+	for x := 90.0; x <= 140; x += 2 {
+		for y := 75.0; y <= 125; y += 2 {
+			set(x, y, 0)
+		}
+	}
+	if piece {
+		for x := 90.0; x <= 110; x += 2 {
+			for y := 90.0; y <= 110; y += 2 {
+				set(x, y, 40+math.Hypot(x-100, y-100)*-0.5)
+			}
+		}
+		set(100, 100, 50)
+		for z := 10.0; z <= 40; z += 2 {
+			set(150, 100, z)
+		}
+	}
+	return pc
+}
+
+func TestHighestNear(t *testing.T) {
+	pc := pointcloud.NewBasicEmpty()
+	test.That(t, pc.Set(r3.Vector{100, 100, 45}, nil), test.ShouldBeNil)
+	test.That(t, pc.Set(r3.Vector{140, 100, 90}, nil), test.ShouldBeNil) // the side of a king next door
+
+	test.That(t, highestNear(pc, r3.Vector{100, 100, 0}, 0).Z, test.ShouldEqual, 90)
+	test.That(t, highestNear(pc, r3.Vector{100, 100, 0}, 50).Z, test.ShouldEqual, 45)
+	test.That(t, highestNear(pc, r3.Vector{300, 300, 0}, 50).Z, test.ShouldEqual, 90)
+
+	s := &viamChessChess{conf: &ChessConfig{SquareSize: 50, BoardA1: &r3.Vector{75, 75, 0}}}
+	test.That(t, s.squareTop(pc, "a1").Z, test.ShouldEqual, 45)
+	s.conf.HighRegion = 100
+	test.That(t, s.squareTop(pc, "a1").Z, test.ShouldEqual, 90)
+}
+
+func TestSquareWorldCenter(t *testing.T) {
+	pc := tiltedSquare(t, true)
+	center, ok := squareWorldCenter(pc, true, 0)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, center.X, test.ShouldAlmostEqual, 100, 0.5)
+	test.That(t, center.Y, test.ShouldAlmostEqual, 100, 0.5)
+	test.That(t, center.Z, test.ShouldEqual, 50)
+
+	// what the bounding box said before, dragged toward the neighbor
+	md := pc.MetaData()
+	test.That(t, md.Center().X, test.ShouldBeGreaterThan, 115)
+
+	center, ok = squareWorldCenter(tiltedSquare(t, false), false, 0)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, center.X, test.ShouldAlmostEqual, 115, 0.5)
+	test.That(t, center.Y, test.ShouldAlmostEqual, 100, 0.5)
+	test.That(t, center.Z, test.ShouldEqual, 0)
+
+	// flat, nothing sticks up
+	_, ok = squareWorldCenter(tiltedSquare(t, false), true, 0)
+	test.That(t, ok, test.ShouldBeFalse)
+
+	_, ok = squareWorldCenter(pointcloud.NewBasicEmpty(), false, 0)
+	test.That(t, ok, test.ShouldBeFalse)
+}
+
+func TestGetCenterForTallNeighbor(t *testing.T) {
+	pc := pointcloud.NewBasicEmpty()
+	set := func(x, y, z float64) {
+		test.That(t, pc.Set(r3.Vector{x, y, z}, nil), test.ShouldBeNil)
+	}
+	for x := 0.0; x <= 60; x += 2 {
+		for y := 0.0; y <= 60; y += 2 {
+			set(x, y, 0)
+		}
+	}
+	for x := 26.0; x <= 34; x += 2 {
+		for y := 26.0; y <= 34; y += 2 {
+			set(x, y, 50)
+		}
+	}
+	// a king on the next square leaning into this one's image box
+	for y := 20.0; y <= 40; y += 2 {
+		set(70, y, 90)
+	}
+
+	o, err := viz.NewObjectWithLabel(pc, "e4-1", nil)
+	test.That(t, err, test.ShouldBeNil)
+	data := viscapture.VisCapture{Objects: []*viz.Object{o}}
+
+	s := &viamChessChess{logger: logging.NewTestLogger(t), conf: &ChessConfig{}}
+	center, err := s.getCenterFor(data, "e4", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, center.X, test.ShouldAlmostEqual, 30, 0.5)
+	test.That(t, center.Y, test.ShouldAlmostEqual, 30, 0.5)
+	test.That(t, center.Z, test.ShouldEqual, 50)
+
+	// a high-region wider than the square lets the neighbor back in
+	s.conf.HighRegion = 200
+	center, err = s.getCenterFor(data, "e4", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, center.Z, test.ShouldEqual, 90)
+}
+
+func TestSleep(t *testing.T) {
+	test.That(t, sleep(context.Background(), time.Millisecond), test.ShouldBeNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	err := sleep(ctx, time.Hour)
+	test.That(t, err, test.ShouldEqual, context.Canceled)
+	test.That(t, time.Since(start), test.ShouldBeLessThan, time.Second)
+}
+
+func TestMoveTimeout(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.moveTimeout(), test.ShouldEqual, 30*time.Second)
+
+	cfg.MoveTimeoutSec = 5
+	test.That(t, cfg.moveTimeout(), test.ShouldEqual, 5*time.Second)
+}
+
+func TestStartPosition(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.startPosition(), test.ShouldEqual, uint32(2))
+
+	zero := 0
+	cfg.StartPosition = &zero
+	test.That(t, cfg.startPosition(), test.ShouldEqual, uint32(0))
+}
+
+func TestSettle(t *testing.T) {
+	cfg := &ChessConfig{}
+	test.That(t, cfg.settle(), test.ShouldEqual, time.Second)
+
+	cfg.SettleMs = 250
+	test.That(t, cfg.settle(), test.ShouldEqual, 250*time.Millisecond)
+}
+
+func TestDryRun(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{}}
+	ctx := context.Background()
+	test.That(t, s.dryRun(ctx), test.ShouldBeFalse)
+	test.That(t, s.dryRun(withDryRun(ctx, false)), test.ShouldBeFalse)
+	test.That(t, s.dryRun(withDryRun(ctx, true)), test.ShouldBeTrue)
+
+	s.conf.DryRun = true
+	test.That(t, s.dryRun(ctx), test.ShouldBeTrue)
+}
+
+func TestStop(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t)}
+	test.That(t, s.stop(), test.ShouldNotBeNil)
+
+	stopped, done := s.startGame()
+	test.That(t, stopped.Err(), test.ShouldBeNil)
+	test.That(t, s.stop(), test.ShouldBeNil)
+	test.That(t, stopped.Err(), test.ShouldNotBeNil)
+
+	done()
+	test.That(t, s.stop(), test.ShouldNotBeNil)
+}
+
+func TestDryRunLeavesHardwareAlone(t *testing.T) {
+	// no arm, gripper or motion, so anything that reaches them panics
+	s := &viamChessChess{conf: &ChessConfig{DryRun: true, TravelSpeed: 100}, logger: logging.NewTestLogger(t)}
+	ctx := context.Background()
+
+	test.That(t, s.moveGripper(ctx, r3.Vector{X: 100, Y: 100, Z: 200}), test.ShouldBeNil)
+	test.That(t, s.gripperOpen(ctx), test.ShouldBeNil)
+	test.That(t, s.openGripper(ctx, 500), test.ShouldBeNil)
+	got, err := s.myGrab(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, got, test.ShouldBeTrue)
+}
+
+func TestRobotColor(t *testing.T) {
+	game, err := newGame("")
+	test.That(t, err, test.ShouldBeNil)
+
+	theState := &state{game: game}
+
+	cfg := &ChessConfig{}
+	test.That(t, cfg.robotsTurn(theState), test.ShouldBeTrue)
+
+	cfg.RobotColor = "black"
+	test.That(t, cfg.robotsTurn(theState), test.ShouldBeFalse)
+	test.That(t, game.PushMove("e4", nil), test.ShouldBeNil)
+	test.That(t, cfg.robotsTurn(theState), test.ShouldBeTrue)
+
+	cfg.RobotColor = "White"
+	test.That(t, cfg.robotsTurn(theState), test.ShouldBeFalse)
+
+	// the game's own color wins, for alternate-colors
+	theState.robot = chess.Black
+	test.That(t, cfg.robotsTurn(theState), test.ShouldBeTrue)
+
+	cfg.RobotColor = "purple"
+	_, err = cfg.robotColor()
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestNoEngine(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t), conf: &ChessConfig{NoEngine: true}}
+	game := chess.NewGame()
+
+	for ply := 0; ply < 40 && gameOver(game) == nil; ply++ {
+		m, err := s.pickMove(context.Background(), game, nil)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, game.Move(m, nil), test.ShouldBeNil)
+	}
+	test.That(t, len(game.Moves()), test.ShouldBeGreaterThan, 0)
+}
+
+func TestPickMoveGameOver(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t), conf: &ChessConfig{}}
+
+	// fool's mate
+	f, err := chess.FEN("rnb1kbnr/pppp1ppp/8/4p3/6Pq/5P2/PPPPP2P/RNBQKBNR w KQkq - 1 3")
+	test.That(t, err, test.ShouldBeNil)
+	_, err = s.pickMove(context.Background(), chess.NewGame(f), nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldEqual, "game is over: 0-1 by Checkmate")
+}
+
+func TestEnginePosition(t *testing.T) {
+	f, err := chess.FEN("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	test.That(t, err, test.ShouldBeNil)
+	game := chess.NewGame(f)
+	start := game.FEN()
+	rng := rand.New(rand.NewSource(1))
+
+	for ply := 0; ply < 20; ply++ {
+		moves := game.ValidMoves()
+		test.That(t, game.Move(&moves[rng.Intn(len(moves))], nil), test.ShouldBeNil)
+
+		// what the engine is told has to end up exactly where the game is
+		cmd := enginePosition(game)
+		test.That(t, cmd.Position.String(), test.ShouldEqual, start)
+		test.That(t, len(cmd.Moves), test.ShouldEqual, ply+1)
+
+		uciMoves := []string{}
+		for _, m := range cmd.Moves {
+			uciMoves = append(uciMoves, m.String())
+		}
+		replayed, err := replayMoves(start, uciMoves)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, replayed.FEN(), test.ShouldEqual, game.FEN())
+		test.That(t, cmd.String(), test.ShouldEndWith, " "+uciMoves[len(uciMoves)-1])
+	}
+}
+
+func TestBlunderMove(t *testing.T) {
+	game, err := newGame("")
+	test.That(t, err, test.ShouldBeNil)
+	rng := rand.New(rand.NewSource(1))
+
+	pv := func(m string, cp int) uci.Info {
+		mm, err := chess.UCINotation{}.Decode(nil, m)
+		test.That(t, err, test.ShouldBeNil)
+		return uci.Info{PV: []*chess.Move{mm}, Score: uci.Score{CP: cp}}
+	}
+
+	res := uci.SearchResults{MultiPVInfo: []uci.Info{pv("e2e4", 30), pv("a2a3", -10), pv("g1h3", -20)}}
+	for range 20 {
+		m, score := blunderMove(res, rng, game)
+		test.That(t, m.String(), test.ShouldBeIn, "a2a3", "g1h3")
+		test.That(t, score, test.ShouldNotBeNil)
+		test.That(t, score.CP, test.ShouldBeLessThan, 0)
+	}
+
+	// only the best move known, so anything legal
+	m, score := blunderMove(uci.SearchResults{MultiPVInfo: []uci.Info{pv("e2e4", 30)}}, rng, game)
+	test.That(t, m, test.ShouldNotBeNil)
+	test.That(t, score, test.ShouldBeNil)
+}
+
+func TestPostWebhook(t *testing.T) {
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	err := postWebhook(context.Background(), srv.URL, []byte(`{"move":"e2e4"}`))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, string(got), test.ShouldEqual, `{"move":"e2e4"}`)
+
+	err = postWebhook(context.Background(), srv.URL+"/broken", []byte(`{}`))
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "502")
+}
+
+func TestSpokenMove(t *testing.T) {
+	play := func(fen string, moves ...string) string {
+		f, err := chess.FEN(fen)
+		test.That(t, err, test.ShouldBeNil)
+		game := chess.NewGame(f)
+		for _, m := range moves[:len(moves)-1] {
+			test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+		}
+		before := game.Position()
+		m, err := parseMove(game, moves[len(moves)-1], "")
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, game.Move(m, nil), test.ShouldBeNil)
+		return spokenMove(before, m, game)
+	}
+
+	start := chess.NewGame().FEN()
+	test.That(t, play(start, "e4"), test.ShouldEqual, "pawn to e4")
+	test.That(t, play(start, "e4", "d5", "exd5"), test.ShouldEqual, "pawn takes d5")
+	test.That(t, play(start, "e4", "f5", "Qh5+"), test.ShouldEqual, "queen to h5, check")
+	test.That(t, play(start, "f3", "e5", "g4", "Qh4#"), test.ShouldEqual, "queen to h4, checkmate")
+	test.That(t, play("4k3/8/8/8/8/8/8/4K2R w K - 0 1", "O-O"), test.ShouldEqual, "castles kingside")
+	test.That(t, play("3rk3/2P5/8/8/8/8/8/4K3 w - - 0 1", "cxd8=Q+"), test.ShouldEqual, "pawn takes d8, promotes to queen, check")
+}
+
+func TestShowTurn(t *testing.T) {
+	ctx := context.Background()
+	s := &viamChessChess{logger: logging.NewTestLogger(t), conf: &ChessConfig{}}
+	s.showTurn(ctx, true) // no indicator, nothing to do
+
+	sw := &fakeSwitch{}
+	s.turnIndicator = sw
+	s.showTurn(ctx, true)
+	s.showTurn(ctx, false)
+	test.That(t, sw.positions, test.ShouldResemble, []uint32{1, 0})
+
+	sw.err = errors.New("unplugged")
+	s.showTurn(ctx, true) // only logged
+}
+
+// boardCapture is a capture with a small flat square for every square, occupied ones with a piece on them
+func boardCapture(t *testing.T, occupied ...string) viscapture.VisCapture {
+	data := viscapture.VisCapture{}
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		x, y := float64(sq.File())*50, float64(sq.Rank())*50
+		pc := pointcloud.NewBasicEmpty()
+		for dx := 0.0; dx <= 40; dx += 10 {
+			for dy := 0.0; dy <= 40; dy += 10 {
+				test.That(t, pc.Set(r3.Vector{x + dx, y + dy, 0}, nil), test.ShouldBeNil)
+			}
+		}
+
+		label := sq.String() + "-0"
+		if slices.Contains(occupied, sq.String()) {
+			label = sq.String() + "-1"
+			test.That(t, pc.Set(r3.Vector{x + 20, y + 20, 50}, nil), test.ShouldBeNil)
+		}
+		o, err := viz.NewObjectWithLabel(pc, label, nil)
+		test.That(t, err, test.ShouldBeNil)
+		data.Objects = append(data.Objects, o)
+	}
+	return data
+}
+
+func TestCastleOntoOccupiedSquare(t *testing.T) {
+	s := &viamChessChess{logger: logging.NewTestLogger(t), conf: &ChessConfig{}}
+	ctx := withDryRun(context.Background(), true)
+
+	game, err := newGame("r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	theState := &state{game: game}
+	m, err := parseMove(game, "", "e1g1")
+	test.That(t, err, test.ShouldBeNil)
+
+	// the camera thinks there's something where the king is going
+	err = s.movePiece(ctx, boardCapture(t, "e1", "g1", "h1"), theState, "e1", "g1", m)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(theState.graveyard), test.ShouldEqual, 1)
+}
+
+// fakePieceFinder always sees the same board
+type fakePieceFinder struct {
+	vision.Service
+	data viscapture.VisCapture
+}
+
+func (f *fakePieceFinder) CaptureAllFromCamera(
+	ctx context.Context, cameraName string, opts viscapture.CaptureOptions, extra map[string]interface{},
+) (viscapture.VisCapture, error) {
+	return f.data, nil
+}
+
+func TestPromoteOntoOccupiedSquare(t *testing.T) {
+	s := &viamChessChess{
+		logger: logging.NewTestLogger(t),
+		conf:   &ChessConfig{PromotionReserve: map[string]r3.Vector{"Q": {X: 500, Y: 0, Z: 60}}},
+	}
+	ctx := withDryRun(context.Background(), true)
+
+	game, err := newGame("4k3/P7/8/8/8/8/8/4K3 w - - 0 1")
+	test.That(t, err, test.ShouldBeNil)
+	theState := &state{game: game}
+	m, err := parseMove(game, "", "a7a8q")
+	test.That(t, err, test.ShouldBeNil)
+
+	// the look after taking the pawn off still shows something on a8
+	s.pieceFinder = &fakePieceFinder{data: boardCapture(t, "a8", "e1", "e8")}
+	err = s.promote(ctx, boardCapture(t, "a7", "e1", "e8"), theState, m)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(theState.graveyard), test.ShouldEqual, 2)
+}
+
+type fakeSwitch struct {
+	toggleswitch.Switch
+	positions []uint32
+	err       error
+}
+
+func (f *fakeSwitch) SetPosition(ctx context.Context, position uint32, extra map[string]interface{}) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.positions = append(f.positions, position)
+	return nil
+}
+
+func TestCapturedPieces(t *testing.T) {
+	game := chess.NewGame()
+	test.That(t, capturedPieces(game), test.ShouldResemble, map[string]interface{}{"white": []interface{}{}, "black": []interface{}{}})
+
+	for _, m := range []string{"e4", "d5", "exd5", "Qxd5", "Nc3", "Qe5+", "Qe2", "Qxe2+", "Bxe2", "a5", "b4", "a4", "b5", "c5", "bxc6"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	test.That(t, capturedPieces(game), test.ShouldResemble, map[string]interface{}{
+		"white": []interface{}{"pawn", "queen"},
+		"black": []interface{}{"pawn", "queen", "pawn"},
+	})
+}
+
+func TestLastCapture(t *testing.T) {
+	game := chess.NewGame()
+	test.That(t, lastCapture(game), test.ShouldResemble, map[string]interface{}{"is_capture": false})
+
+	test.That(t, game.PushMove("e4", nil), test.ShouldBeNil)
+	test.That(t, lastCapture(game), test.ShouldResemble, map[string]interface{}{"is_capture": false})
+
+	for _, m := range []string{"d5", "e5", "f5", "exf6"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	test.That(t, lastCapture(game), test.ShouldResemble, map[string]interface{}{"is_capture": true, "captured": "pawn"})
+
+	test.That(t, game.PushMove("Nxf6", nil), test.ShouldBeNil)
+	test.That(t, lastCapture(game), test.ShouldResemble, map[string]interface{}{"is_capture": true, "captured": "pawn"})
+}
+
+func TestAlternateColors(t *testing.T) {
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{RobotColor: "white", AlternateColors: true},
+		fenFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	ctx := context.Background()
+
+	theState, err := s.startNewGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, s.conf.robotFor(theState), test.ShouldEqual, chess.White)
+
+	// nothing played yet, so no swap
+	theState, err = s.startNewGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, s.conf.robotFor(theState), test.ShouldEqual, chess.White)
+
+	test.That(t, theState.game.PushMove("e4", nil), test.ShouldBeNil)
+	test.That(t, s.saveGame(ctx, theState), test.ShouldBeNil)
+
+	theState, err = s.startNewGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, s.conf.robotFor(theState), test.ShouldEqual, chess.Black)
+
+	theState, err = s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.robot, test.ShouldEqual, chess.Black)
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+	for _, c := range []cmdStruct{{State: true}, {PGN: true}, {LegalMoves: "e2"}, {LegalMoves: true}, {Analyze: 3}, {Hint: true}, {Captured: true}} {
+		test.That(t, c.readOnly(), test.ShouldBeTrue)
+	}
+	for _, c := range []cmdStruct{{Go: 1}, {SAN: "e4"}, {Undo: 1}, {NewGame: true}, {LegalMoves: false}} {
+		test.That(t, c.readOnly(), test.ShouldBeFalse)
+	}
+}
+
+func TestMoveCmdValidate(t *testing.T) {
+	test.That(t, (&MoveCmd{From: "e2", To: "e4"}).validate(), test.ShouldBeNil)
+	test.That(t, (&MoveCmd{From: "e2", To: "-"}).validate(), test.ShouldBeNil)
+	test.That(t, (&MoveCmd{From: "X3", To: "a1"}).validate(), test.ShouldBeNil)
+
+	err := (&MoveCmd{From: "e2", To: "e9"}).validate()
+	test.That(t, err.Error(), test.ShouldContainSubstring, "e9")
+
+	err = (&MoveCmd{From: "", To: "e4"}).validate()
+	test.That(t, err.Error(), test.ShouldContainSubstring, "from")
+
+	test.That(t, (&MoveCmd{From: "-", To: "e4"}).validate(), test.ShouldNotBeNil)
+	test.That(t, (&MoveCmd{From: "Xa", To: "e4"}).validate(), test.ShouldNotBeNil)
+}
+
+func TestPieceNotFoundError(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{BoardA1: &r3.Vector{}, SquareSize: 50}}
+
+	_, err := s.getCenterFor(viscapture.VisCapture{}, "e4", nil)
+	var notFound *PieceNotFoundError
+	test.That(t, errors.As(err, &notFound), test.ShouldBeTrue)
+	test.That(t, notFound.Square, test.ShouldEqual, "e4")
+	test.That(t, err.Error(), test.ShouldEqual, "can't find object for: e4 and no board-z")
+
+	var grabFailed *GrabFailedError
+	test.That(t, errors.As(err, &grabFailed), test.ShouldBeFalse)
+}
+
+func TestDependencyError(t *testing.T) {
+	test.That(t, dependencyError("arm", "my-arm", nil), test.ShouldBeNil)
+
+	err := dependencyError("arm", "my-arm", errors.New("not found"))
+	test.That(t, err.Error(), test.ShouldEqual, `can't get arm "my-arm": not found`)
+}
+
+func TestReadings(t *testing.T) {
+	game := chess.NewGame()
+	r := readings(game, nil)
+	test.That(t, r["turn"], test.ShouldEqual, "white")
+	test.That(t, r["ply"], test.ShouldEqual, 0)
+	test.That(t, r["last_move"], test.ShouldEqual, "")
+	_, ok := r["eval_cp"]
+	test.That(t, ok, test.ShouldBeFalse)
+
+	test.That(t, game.PushMove("e4", nil), test.ShouldBeNil)
+	r = readings(game, &uci.Score{CP: 35})
+	test.That(t, r["turn"], test.ShouldEqual, "black")
+	test.That(t, r["ply"], test.ShouldEqual, 1)
+	test.That(t, r["last_move"], test.ShouldEqual, "e2e4")
+	test.That(t, r["eval_cp"], test.ShouldEqual, 35)
+}
+
+func TestPieceAxis(t *testing.T) {
+	// a piece lying diagonally, from 300,300 up to 340,340, on a board at z 0
+	pc := pointcloud.NewBasicEmpty()
+	for d := 0.0; d <= 40; d += 2 {
+		test.That(t, pc.Set(r3.Vector{300 + d, 300 + d, 20}, nil), test.ShouldBeNil)
+		test.That(t, pc.Set(r3.Vector{300 + d, 340 - d, 0}, nil), test.ShouldBeNil)
+	}
+
+	axis, ok := pieceAxis([]pointcloud.PointCloud{pc})
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, axis.X, test.ShouldAlmostEqual, math.Sqrt2/2, .01)
+	test.That(t, axis.Y, test.ShouldAlmostEqual, math.Sqrt2/2, .01)
+
+	// same piece on the other side of the arm points the other way
+	far := pointcloud.NewBasicEmpty()
+	for d := 0.0; d <= 40; d += 2 {
+		test.That(t, far.Set(r3.Vector{-300 - d, -300 - d, 20}, nil), test.ShouldBeNil)
+		test.That(t, far.Set(r3.Vector{-300 - d, -340 + d, 0}, nil), test.ShouldBeNil)
+	}
+	axis, ok = pieceAxis([]pointcloud.PointCloud{far})
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, axis.X, test.ShouldAlmostEqual, -math.Sqrt2/2, .01)
+
+	_, ok = pieceAxis([]pointcloud.PointCloud{pointcloud.NewBasicEmpty()})
+	test.That(t, ok, test.ShouldBeFalse)
+}
+
+func TestFallenPieceCenter(t *testing.T) {
+	s := &viamChessChess{conf: &ChessConfig{}}
+	data := boardCapture(t, "e4")
+
+	// past the old fixed search box
+	far := pointcloud.NewBasicEmpty()
+	test.That(t, far.Set(r3.Vector{1500, 20, 0}, nil), test.ShouldBeNil)
+	test.That(t, far.Set(r3.Vector{1510, 30, 25}, nil), test.ShouldBeNil)
+	o, err := viz.NewObjectWithLabel(far, "a1-1", nil)
+	test.That(t, err, test.ShouldBeNil)
+	data.Objects[0] = o
+
+	top, err := s.fallenPieceCenter(data, []string{"a1"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, top, test.ShouldResemble, r3.Vector{1510, 30, 25})
+
+	top, err = s.fallenPieceCenter(data, []string{"e3", "e4"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, top.Z, test.ShouldEqual, 50)
+
+	_, err = s.fallenPieceCenter(data, []string{"z9"})
+	test.That(t, err, test.ShouldNotBeNil)
+}
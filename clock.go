@@ -0,0 +1,108 @@
+package viamchess
+
+import (
+	"time"
+
+	"github.com/corentings/chess/v2"
+)
+
+// TimeControl is a chess clock, base time per side plus an increment after every move
+type TimeControl struct {
+	BaseSec      float64 `json:"base-sec"`
+	IncrementSec float64 `json:"increment-sec"`
+}
+
+func (tc *TimeControl) base() time.Duration {
+	return time.Duration(tc.BaseSec * float64(time.Second))
+}
+
+func (tc *TimeControl) increment() time.Duration {
+	return time.Duration(tc.IncrementSec * float64(time.Second))
+}
+
+// clock is the time each side has left, saved with the game so it survives restarts
+type clock struct {
+	WhiteMs     int64     `json:"white_ms"`
+	BlackMs     int64     `json:"black_ms"`
+	IncrementMs int64     `json:"increment_ms"`
+	TurnStart   time.Time `json:"turn_start"`        // when the side to move started thinking
+	Flagged     string    `json:"flagged,omitempty"` // "w" or "b" if that side ran out of time
+
+	// lichess keeps the real clock and says when someone runs out, this one only paces the engine and never flags
+	Lichess bool `json:"lichess,omitempty"`
+}
+
+func newClock(tc *TimeControl, now time.Time) *clock {
+	return &clock{
+		WhiteMs:     tc.base().Milliseconds(),
+		BlackMs:     tc.base().Milliseconds(),
+		IncrementMs: tc.increment().Milliseconds(),
+		TurnStart:   now,
+	}
+}
+
+func (c *clock) increment() time.Duration {
+	return time.Duration(c.IncrementMs) * time.Millisecond
+}
+
+func (c *clock) remaining(color chess.Color) time.Duration {
+	if color == chess.White {
+		return time.Duration(c.WhiteMs) * time.Millisecond
+	}
+	return time.Duration(c.BlackMs) * time.Millisecond
+}
+
+func (c *clock) setRemaining(color chess.Color, d time.Duration) {
+	if color == chess.White {
+		c.WhiteMs = d.Milliseconds()
+	} else {
+		c.BlackMs = d.Milliseconds()
+	}
+}
+
+// punch charges mover for the time since their turn started and starts the other side's, true if mover ran out
+func (c *clock) punch(mover chess.Color, now time.Time) bool {
+	left := c.remaining(mover) - now.Sub(c.TurnStart)
+	c.TurnStart = now
+	if left <= 0 && c.Lichess {
+		left = 0
+	} else if left <= 0 {
+		c.setRemaining(mover, 0)
+		c.Flagged = mover.String()
+		return true
+	}
+	c.setRemaining(mover, left+c.increment())
+	return false
+}
+
+// moveTime is how long the engine should think for color, about a 30th of what's left plus most of the increment
+func (c *clock) moveTime(color chess.Color) time.Duration {
+	left := c.remaining(color)
+	t := left/30 + c.increment()*3/4
+	return max(50*time.Millisecond, min(t, left/2))
+}
+
+// addClock adds both sides' time left to m, counting down the side to move's while the game is on
+func addClock(m map[string]interface{}, c *clock, game *chess.Game, now time.Time) {
+	white, black := c.remaining(chess.White), c.remaining(chess.Black)
+	if game.Outcome() == chess.NoOutcome {
+		if game.Position().Turn() == chess.White {
+			white = max(0, white-now.Sub(c.TurnStart))
+		} else {
+			black = max(0, black-now.Sub(c.TurnStart))
+		}
+	}
+	m["white_ms"] = white.Milliseconds()
+	m["black_ms"] = black.Milliseconds()
+}
+
+// flag ends game as a loss on time for color
+func flag(game *chess.Game, color chess.Color) {
+	game.Resign(color)
+	game.AddTagPair("Termination", "time forfeit")
+}
+
+// lostOnTime is true if game ended by someone's clock running out
+func lostOnTime(game *chess.Game) bool {
+	return game.GetTagPair("Termination") == "time forfeit"
+}
@@ -0,0 +1,90 @@
+package viamchess
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/test"
+
+	"github.com/corentings/chess/v2"
+)
+
+func TestClockPunch(t *testing.T) {
+	tc := &TimeControl{BaseSec: 60, IncrementSec: 2}
+	now := time.Now()
+	c := newClock(tc, now)
+	test.That(t, c.remaining(chess.White), test.ShouldEqual, time.Minute)
+
+	now = now.Add(10 * time.Second)
+	test.That(t, c.punch(chess.White, now), test.ShouldBeFalse)
+	test.That(t, c.remaining(chess.White), test.ShouldEqual, 52*time.Second)
+	test.That(t, c.remaining(chess.Black), test.ShouldEqual, time.Minute)
+
+	now = now.Add(61 * time.Second)
+	test.That(t, c.punch(chess.Black, now), test.ShouldBeTrue)
+	test.That(t, c.remaining(chess.Black), test.ShouldEqual, time.Duration(0))
+	test.That(t, c.Flagged, test.ShouldEqual, "b")
+}
+
+func TestLichessClockNeverFlags(t *testing.T) {
+	now := time.Now()
+	c := &clock{WhiteMs: 1000, BlackMs: 1000, TurnStart: now, Lichess: true}
+
+	test.That(t, c.punch(chess.White, now.Add(5*time.Second)), test.ShouldBeFalse)
+	test.That(t, c.remaining(chess.White), test.ShouldEqual, time.Duration(0))
+	test.That(t, c.Flagged, test.ShouldEqual, "")
+}
+
+func TestClockMoveTime(t *testing.T) {
+	tc := &TimeControl{BaseSec: 300, IncrementSec: 4}
+	c := newClock(tc, time.Now())
+	test.That(t, c.moveTime(chess.White), test.ShouldEqual, 13*time.Second)
+
+	c.WhiteMs = 2000
+	test.That(t, c.moveTime(chess.White), test.ShouldEqual, time.Second)
+
+	c.WhiteMs = 10
+	test.That(t, c.moveTime(chess.White), test.ShouldEqual, 50*time.Millisecond)
+}
+
+func TestAddClock(t *testing.T) {
+	tc := &TimeControl{BaseSec: 60}
+	now := time.Now()
+	c := newClock(tc, now)
+	game := chess.NewGame()
+
+	m := map[string]interface{}{}
+	addClock(m, c, game, now.Add(5*time.Second))
+	test.That(t, m["white_ms"], test.ShouldEqual, int64(55000))
+	test.That(t, m["black_ms"], test.ShouldEqual, int64(60000))
+}
+
+func TestLostOnTime(t *testing.T) {
+	s := &viamChessChess{
+		logger:  logging.NewTestLogger(t),
+		conf:    &ChessConfig{TimeControl: &TimeControl{BaseSec: 60}},
+		fenFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	ctx := context.Background()
+
+	theState, err := s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theState.clock, test.ShouldNotBeNil)
+
+	theState.clock.TurnStart = time.Now().Add(-2 * time.Minute)
+	m, err := parseMove(theState.game, "e4", "")
+	test.That(t, err, test.ShouldBeNil)
+	err = s.applyMove(ctx, theState, m)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(theState.game), test.ShouldResemble, map[string]interface{}{"outcome": "0-1", "method": "Timeout"})
+
+	// still over after reading it back
+	theState, err = s.getGame(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gameOver(theState.game), test.ShouldResemble, map[string]interface{}{"outcome": "0-1", "method": "Timeout"})
+	test.That(t, gamePGN(theState.game), test.ShouldContainSubstring, `[Termination "time forfeit"]`)
+	test.That(t, theState.clock.Flagged, test.ShouldEqual, "w")
+}
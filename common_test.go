@@ -0,0 +1,19 @@
+package viamchess
+
+import (
+	"testing"
+
+	"go.viam.com/rdk/resource"
+	generic "go.viam.com/rdk/services/generic"
+	"go.viam.com/rdk/services/vision"
+	"go.viam.com/test"
+)
+
+// cmd/module serves these, so they all need to be registered
+func TestModelsRegistered(t *testing.T) {
+	_, ok := resource.LookupRegistration(vision.API, PieceFinderModel)
+	test.That(t, ok, test.ShouldBeTrue)
+
+	_, ok = resource.LookupRegistration(generic.API, ChessModel)
+	test.That(t, ok, test.ShouldBeTrue)
+}
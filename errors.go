@@ -0,0 +1,54 @@
+package viamchess
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// PieceNotFoundError is when vision has nothing for a square, so there's nothing to grab or nowhere to put it
+type PieceNotFoundError struct {
+	Square string
+}
+
+func (e *PieceNotFoundError) Error() string {
+	return fmt.Sprintf("can't find object for: %s", e.Square)
+}
+
+// GrabFailedError is when the gripper came up empty all the way down to MinZ
+type GrabFailedError struct {
+	Square string
+	MinZ   float64
+}
+
+func (e *GrabFailedError) Error() string {
+	return fmt.Sprintf("couldn't grab %s, and scared to go below grab-min-z (%v)", e.Square, e.MinZ)
+}
+
+// BoardNeedsHelpError is when a piece the arm needs is lying down or off its square, so a person has to fix it first
+type BoardNeedsHelpError struct {
+	Problems map[string]string // square to "toppled" or "off-grid"
+}
+
+func (e *BoardNeedsHelpError) Error() string {
+	squares := []string{}
+	for sq, problem := range e.Problems {
+		squares = append(squares, sq+" "+problem)
+	}
+	slices.Sort(squares)
+	return fmt.Sprintf("board needs a hand before moving: %s", strings.Join(squares, ", "))
+}
+
+// CorruptGameError is a saved game that's there but can't be made sense of, e.g. a write cut off by losing power
+type CorruptGameError struct {
+	File string
+	Err  error
+}
+
+func (e *CorruptGameError) Error() string {
+	return fmt.Sprintf("saved game (%s) is corrupt: %v", e.File, e.Err)
+}
+
+func (e *CorruptGameError) Unwrap() error {
+	return e.Err
+}
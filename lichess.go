@@ -0,0 +1,141 @@
+package viamchess
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const lichessURL = "https://lichess.org"
+
+// lichessClient is the little bit of the lichess bot api needed to play one game
+type lichessClient struct {
+	baseURL string
+	token   string
+}
+
+func newLichessClient(token string) *lichessClient {
+	return &lichessClient{baseURL: lichessURL, token: token}
+}
+
+type lichessPlayer struct {
+	ID string `json:"id"`
+}
+
+type lichessState struct {
+	Moves  string `json:"moves"` // every move so far in uci, space separated
+	WTime  int64  `json:"wtime"` // ms
+	BTime  int64  `json:"btime"`
+	WInc   int64  `json:"winc"`
+	BInc   int64  `json:"binc"`
+	Status string `json:"status"` // "started" until the game ends, then why it ended, e.g. "mate" or "outoftime"
+}
+
+// lichessEvent is a line of the game stream, a gameFull first and then a gameState after every move
+type lichessEvent struct {
+	Type  string        `json:"type"`
+	White lichessPlayer `json:"white"`
+	Black lichessPlayer `json:"black"`
+	State *lichessState `json:"state"` // where gameFull has it
+	lichessState
+}
+
+func (e *lichessEvent) state() *lichessState {
+	if e.State != nil {
+		return e.State
+	}
+	return &e.lichessState
+}
+
+func (st *lichessState) over() bool {
+	return st.Status != "" && st.Status != "created" && st.Status != "started"
+}
+
+func (c *lichessClient) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("lichess %s %s returned %s: %s", method, path, res.Status, bytes.TrimSpace(body))
+	}
+	return res, nil
+}
+
+// account is the id of the lichess account the token belongs to
+func (c *lichessClient) account(ctx context.Context) (string, error) {
+	res, err := c.do(ctx, http.MethodGet, "/api/account")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var me lichessPlayer
+	err = json.NewDecoder(res.Body).Decode(&me)
+	if err != nil {
+		return "", err
+	}
+	return me.ID, nil
+}
+
+// stream calls fn with every event of a game until fn says it's done, the stream ends, or ctx is done
+func (c *lichessClient) stream(ctx context.Context, gameID string, fn func(lichessEvent) (bool, error)) error {
+	res, err := c.do(ctx, http.MethodGet, "/api/bot/game/stream/"+gameID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue // keep alive
+		}
+
+		var e lichessEvent
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			return fmt.Errorf("bad lichess event %q: %w", line, err)
+		}
+
+		done, err := fn(e)
+		if err != nil || done {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func (c *lichessClient) move(ctx context.Context, gameID, uciMove string) error {
+	res, err := c.do(ctx, http.MethodPost, "/api/bot/game/"+gameID+"/move/"+uciMove)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *lichessClient) resign(ctx context.Context, gameID string) error {
+	res, err := c.do(ctx, http.MethodPost, "/api/bot/game/"+gameID+"/resign")
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,122 @@
+package viamchess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.viam.com/test"
+
+	"github.com/corentings/chess/v2"
+)
+
+func fakeLichess(t *testing.T, stream string) (*lichessClient, *[]string) {
+	posted := &[]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/account":
+			fmt.Fprint(w, `{"id": "robot"}`)
+		case r.URL.Path == "/api/bot/game/stream/abc":
+			fmt.Fprint(w, stream)
+		case r.Method == http.MethodPost:
+			*posted = append(*posted, r.URL.Path)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &lichessClient{baseURL: srv.URL, token: "secret"}, posted
+}
+
+func TestLichessClient(t *testing.T) {
+	ctx := context.Background()
+	client, posted := fakeLichess(t, `{"type":"gameFull","white":{"id":"robot"},"black":{"id":"human"},"state":{"moves":"e2e4","wtime":60000,"btime":60000,"status":"started"}}
+
+{"type":"chatLine","text":"hi"}
+{"type":"gameState","moves":"e2e4 e7e5","wtime":59000,"btime":58000,"winc":2000,"binc":2000,"status":"started"}
+`)
+
+	me, err := client.account(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, me, test.ShouldEqual, "robot")
+
+	events := []lichessEvent{}
+	err = client.stream(ctx, "abc", func(e lichessEvent) (bool, error) {
+		events = append(events, e)
+		return false, nil
+	})
+	test.That(t, errors.Is(err, io.ErrUnexpectedEOF), test.ShouldBeTrue)
+	test.That(t, events, test.ShouldHaveLength, 3)
+	test.That(t, events[0].White.ID, test.ShouldEqual, "robot")
+	test.That(t, events[0].state().Moves, test.ShouldEqual, "e2e4")
+	test.That(t, events[2].state().Moves, test.ShouldEqual, "e2e4 e7e5")
+	test.That(t, events[2].state().BInc, test.ShouldEqual, int64(2000))
+	test.That(t, events[2].state().over(), test.ShouldBeFalse)
+
+	// stops as soon as fn is done
+	events = events[:0]
+	err = client.stream(ctx, "abc", func(e lichessEvent) (bool, error) {
+		events = append(events, e)
+		return true, nil
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, events, test.ShouldHaveLength, 1)
+
+	test.That(t, client.move(ctx, "abc", "g1f3"), test.ShouldBeNil)
+	test.That(t, client.resign(ctx, "abc"), test.ShouldBeNil)
+	test.That(t, *posted, test.ShouldResemble, []string{"/api/bot/game/abc/move/g1f3", "/api/bot/game/abc/resign"})
+
+	err = client.stream(ctx, "nope", func(e lichessEvent) (bool, error) { return false, nil })
+	test.That(t, err.Error(), test.ShouldContainSubstring, "404")
+
+	client.token = "wrong"
+	_, err = client.account(ctx)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "401")
+}
+
+func TestLichessStateOver(t *testing.T) {
+	test.That(t, (&lichessState{Status: "started"}).over(), test.ShouldBeFalse)
+	test.That(t, (&lichessState{Status: "mate"}).over(), test.ShouldBeTrue)
+	test.That(t, (&lichessState{Status: "outoftime"}).over(), test.ShouldBeTrue)
+}
+
+func TestLichessGame(t *testing.T) {
+	id, err := lichessGame("abcd1234", "")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, id, test.ShouldEqual, "abcd1234")
+
+	id, err = lichessGame(true, "wxyz9876")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, id, test.ShouldEqual, "wxyz9876")
+
+	// false is off, not the default game
+	id, err = lichessGame(false, "wxyz9876")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, id, test.ShouldEqual, "")
+
+	_, err = lichessGame(true, "")
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = lichessGame(12.0, "wxyz9876")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestLichessPrefix(t *testing.T) {
+	game := chess.NewGame()
+	for _, m := range []string{"e4", "e5", "Nf3"} {
+		test.That(t, game.PushMove(m, nil), test.ShouldBeNil)
+	}
+	local := game.Moves()
+
+	test.That(t, lichessPrefix(local, []string{"e2e4", "e7e5", "g1f3", "b8c6"}), test.ShouldBeTrue)
+	test.That(t, lichessPrefix(local, []string{"e2e4", "e7e5"}), test.ShouldBeTrue)
+	test.That(t, lichessPrefix(local, []string{}), test.ShouldBeTrue)
+	test.That(t, lichessPrefix(local, []string{"e2e4", "e7e6"}), test.ShouldBeFalse)
+}
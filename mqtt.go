@@ -0,0 +1,156 @@
+package viamchess
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// just enough MQTT 3.1.1 to publish a QoS 0 message, moves are minutes apart so there's no connection to keep open
+
+const mqttTimeout = 5 * time.Second
+
+// mqttBroker is where to publish, URL is host, host:port, tcp://host:port, or ssl:// or mqtts:// for TLS
+type mqttBroker struct {
+	URL      string
+	Username string // optional
+	Password string
+}
+
+// addr is host:port to dial, the port defaults to 1883, or 8883 with TLS
+func (b mqttBroker) addr() (string, bool) {
+	addr, useTLS := b.URL, false
+	for _, prefix := range []string{"ssl://", "mqtts://", "tls://"} {
+		if strings.HasPrefix(addr, prefix) {
+			addr, useTLS = strings.TrimPrefix(addr, prefix), true
+		}
+	}
+	addr = strings.TrimPrefix(addr, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	return addr, useTLS
+}
+
+// mqttPublish connects to broker, publishes payload to topic, and disconnects
+func mqttPublish(ctx context.Context, broker mqttBroker, clientID, topic string, payload []byte) error {
+	addr, useTLS := broker.addr()
+
+	ctx, cancel := context.WithTimeout(ctx, mqttTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = (&tls.Dialer{}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("can't connect to mqtt broker %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	flags := byte(0x02) // clean session
+	if broker.Username != "" {
+		flags |= 0x80
+		if broker.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	connect := &bytes.Buffer{}
+	mqttString(connect, "MQTT")
+	connect.WriteByte(4)         // protocol level 3.1.1
+	connect.WriteByte(flags)     // clean session, and which of username and password follow
+	connect.Write([]byte{0, 60}) // keep alive seconds
+	mqttString(connect, clientID)
+	if flags&0x80 != 0 {
+		mqttString(connect, broker.Username)
+	}
+	if flags&0x40 != 0 {
+		mqttString(connect, broker.Password)
+	}
+	_, err = conn.Write(mqttPacket(0x10, connect.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	ack := make([]byte, 4)
+	_, err = io.ReadFull(conn, ack)
+	if err != nil {
+		return fmt.Errorf("no connack from mqtt broker: %w", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		return fmt.Errorf("mqtt broker sent %x instead of a connack", ack)
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("mqtt broker refused connection, code %d (%s)", ack[3], mqttRefusal(ack[3]))
+	}
+
+	publish := &bytes.Buffer{}
+	mqttString(publish, topic)
+	publish.Write(payload)
+	_, err = conn.Write(mqttPacket(0x30, publish.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write([]byte{0xe0, 0})
+	return err
+}
+
+// mqttPacket is a fixed header with the variable length remaining-length, then body
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// mqttRefusal is what a connack return code means
+func mqttRefusal(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client id rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorized"
+	}
+	return "unknown"
+}
+
+func mqttString(buf *bytes.Buffer, s string) {
+	buf.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	buf.WriteString(s)
+}
@@ -0,0 +1,104 @@
+package viamchess
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+// fakeBroker accepts one connection, acks it with code, and sends back the connect packet's body then everything else the client wrote
+func fakeBroker(t *testing.T, code byte) (string, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	t.Cleanup(func() { l.Close() })
+
+	got := make(chan []byte, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		header := make([]byte, 2)
+		_, err = io.ReadFull(conn, header)
+		if err != nil {
+			return
+		}
+		connect := make([]byte, header[1])
+		_, err = io.ReadFull(conn, connect)
+		if err != nil {
+			return
+		}
+		got <- connect
+		_, err = conn.Write([]byte{0x20, 2, 0, code})
+		if err != nil {
+			return
+		}
+
+		rest, _ := io.ReadAll(conn)
+		got <- rest
+	}()
+	return l.Addr().String(), got
+}
+
+func TestMQTTPublish(t *testing.T) {
+	addr, got := fakeBroker(t, 0)
+
+	err := mqttPublish(context.Background(), mqttBroker{URL: addr}, "test", "chess/moves", []byte(`{"move":"e2e4"}`))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, (<-got)[7], test.ShouldEqual, byte(0x02))
+
+	want := &bytes.Buffer{}
+	mqttString(want, "chess/moves")
+	want.WriteString(`{"move":"e2e4"}`)
+	test.That(t, <-got, test.ShouldResemble, append(mqttPacket(0x30, want.Bytes()), 0xe0, 0))
+}
+
+func TestMQTTPublishRefused(t *testing.T) {
+	addr, _ := fakeBroker(t, 5)
+
+	err := mqttPublish(context.Background(), mqttBroker{URL: addr}, "test", "chess/moves", []byte("{}"))
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "code 5 (not authorized)")
+}
+
+func TestMQTTPublishAuth(t *testing.T) {
+	addr, got := fakeBroker(t, 0)
+
+	err := mqttPublish(context.Background(), mqttBroker{URL: "tcp://" + addr, Username: "robot", Password: "pw"}, "test", "chess/moves", []byte("{}"))
+	test.That(t, err, test.ShouldBeNil)
+
+	want := &bytes.Buffer{}
+	mqttString(want, "test")
+	mqttString(want, "robot")
+	mqttString(want, "pw")
+	connect := <-got
+	test.That(t, connect[7], test.ShouldEqual, byte(0xc2))
+	test.That(t, connect[10:], test.ShouldResemble, want.Bytes())
+}
+
+func TestMQTTBrokerAddr(t *testing.T) {
+	for url, want := range map[string]string{
+		"broker":               "broker:1883",
+		"tcp://broker:1884":    "broker:1884",
+		"ssl://broker":         "broker:8883",
+		"mqtts://broker:18883": "broker:18883",
+	} {
+		addr, _ := mqttBroker{URL: url}.addr()
+		test.That(t, addr, test.ShouldEqual, want)
+	}
+	_, useTLS := mqttBroker{URL: "ssl://broker"}.addr()
+	test.That(t, useTLS, test.ShouldBeTrue)
+	_, useTLS = mqttBroker{URL: "broker"}.addr()
+	test.That(t, useTLS, test.ShouldBeFalse)
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	test.That(t, mqttPacket(0x30, make([]byte, 127))[:2], test.ShouldResemble, []byte{0x30, 127})
+	test.That(t, mqttPacket(0x30, make([]byte, 321))[:3], test.ShouldResemble, []byte{0x30, 0xc1, 0x02})
+}
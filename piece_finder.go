@@ -1,11 +1,22 @@
 package viamchess
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/geo/r3"
 
@@ -30,7 +41,20 @@ import (
 
 var PieceFinderModel = family.WithModel("piece-finder")
 
-const minPieceSize = 25.0
+const defaultMinPieceSize = 25.0
+
+// how long to wait before the first image decode retry; doubles each try
+const imageRetryBackoff = 50 * time.Millisecond
+
+// a standard tournament set, in mm
+var defaultPieceHeights = map[string]float64{
+	"P": 50,
+	"R": 57,
+	"N": 65,
+	"B": 72,
+	"Q": 85,
+	"K": 95,
+}
 
 func init() {
 	resource.RegisterService(vision.API, PieceFinderModel,
@@ -42,12 +66,237 @@ func init() {
 
 type PieceFinderConfig struct {
 	Input string // this is the cropped camera for the board, TODO: what orientation???
+
+	ImageRetries int `json:"image-retries"` // how many times to retry decoding each image
+
+	EmptyHeight float64 `json:"empty-height"` // mm above the board before a square counts as having a piece
+
+	MinPieceSize float64 `json:"min-piece-size"` // mm above the board where a piece's color is sampled, lower for short pieces
+
+	MinPresencePoints int `json:"min-presence-points"` // a piece needs more colored points than this, default 10; higher for dense depth cameras
+
+	// a piece is white if its weighted average brightness is over color-threshold
+	ColorThreshold float64   `json:"color-threshold"` // 0-255, default 128
+	ColorWeights   []float64 `json:"color-weights"`   // r, g, b, default equal; e.g. [1, 1, 0] to ignore blue under warm light
+
+	// "brightness" (default) or "hsv", which scores pale unsaturated pieces high and dark or strongly colored ones low,
+	// better for wooden sets; color-weights don't apply and color-threshold is on the same 0-255 scale
+	ColorMode string `json:"color-mode"`
+
+	WhiteSide string `json:"white-side"` // edge of the image white's first rank is on, "top" (default) or "bottom"
+
+	PieceHeights map[string]float64 `json:"piece-heights"` // mm tall for each of P N B R Q K, defaults are a standard tournament set
+
+	// something over empty-height but shorter than this is a piece lying down, default 60% of the shortest piece
+	ToppledHeight float64 `json:"toppled-height"`
+
+	// x0, y0, x1, y1 of the board in the input image, by default the board is centered and fills the height
+	BoardBounds []int `json:"board-bounds"`
+
+	// for smaller demo boards and variants, default 8; squares are still named a1 and up
+	Ranks int `json:"ranks"` // 1-9
+	Files int `json:"files"` // 1-26
+
+	// mm from the camera to each empty square, what calibrate_empty returns; pieces are measured from here when set
+	EmptyBaseline map[string]float64 `json:"empty-baseline"`
+
+	DebugImage    string `json:"debug-image"`     // where the labeled board goes when extra has printdst, default hack-test.jpg
+	DebugImageDir string `json:"debug-image-dir"` // if set, keep every one as board-<timestamp>.jpg in here instead
+}
+
+func (cfg *PieceFinderConfig) imageRetries() int {
+	if cfg.ImageRetries <= 0 {
+		return 2
+	}
+	return cfg.ImageRetries
+}
+
+func (cfg *PieceFinderConfig) emptyHeight() float64 {
+	if cfg.EmptyHeight <= 0 {
+		return 15
+	}
+	return cfg.EmptyHeight
+}
+
+func (cfg *PieceFinderConfig) debugImage(now time.Time) string {
+	if cfg.DebugImageDir != "" {
+		return filepath.Join(cfg.DebugImageDir, now.Format("board-20060102-150405.000.jpg"))
+	}
+	if cfg.DebugImage == "" {
+		return "hack-test.jpg"
+	}
+	return cfg.DebugImage
+}
+
+func (cfg *PieceFinderConfig) minPieceSize() float64 {
+	if cfg.MinPieceSize == 0 {
+		return defaultMinPieceSize
+	}
+	return cfg.MinPieceSize
+}
+
+func (cfg *PieceFinderConfig) toppledHeight() float64 {
+	if cfg.ToppledHeight > 0 {
+		return cfg.ToppledHeight
+	}
+	heights := cfg.PieceHeights
+	if len(heights) == 0 {
+		heights = defaultPieceHeights
+	}
+	shortest := math.Inf(1)
+	for _, h := range heights {
+		shortest = min(shortest, h)
+	}
+	return shortest * .6
+}
+
+func (cfg *PieceFinderConfig) minPresencePoints() int {
+	if cfg.MinPresencePoints <= 0 {
+		return 10
+	}
+	return cfg.MinPresencePoints
+}
+
+func (cfg *PieceFinderConfig) colorThreshold() float64 {
+	if cfg.ColorThreshold <= 0 {
+		return 128
+	}
+	return cfg.ColorThreshold
+}
+
+// brightness of an average color, using color-weights
+func (cfg *PieceFinderConfig) brightness(r, g, b float64) float64 {
+	if len(cfg.ColorWeights) != 3 {
+		return (r + g + b) / 3.0
+	}
+	w := cfg.ColorWeights
+	return (w[0]*r + w[1]*g + w[2]*b) / (w[0] + w[1] + w[2])
+}
+
+// boardRect is where the board is in an image with the given bounds, and how big its squares are, which are square.
+// By default it's the biggest board that fits in the middle of the image, whichever way round the image is.
+func (cfg *PieceFinderConfig) boardRect(bounds image.Rectangle) (image.Rectangle, int, error) {
+	ranks, files := cfg.ranks(), cfg.files()
+
+	var board image.Rectangle
+	var size int
+	if len(cfg.BoardBounds) == 4 {
+		b := cfg.BoardBounds
+		size = min((b[2]-b[0])/files, (b[3]-b[1])/ranks)
+		board = image.Rect(b[0], b[1], b[0]+size*files, b[1]+size*ranks)
+	} else {
+		size = min(bounds.Dx()/files, bounds.Dy()/ranks)
+		x := bounds.Min.X + (bounds.Dx()-size*files)/2
+		y := bounds.Min.Y + (bounds.Dy()-size*ranks)/2
+		board = image.Rect(x, y, x+size*files, y+size*ranks)
+	}
+
+	if !board.In(bounds) {
+		return board, size, fmt.Errorf("board %v doesn't fit in the %v image, check board-bounds", board, bounds)
+	}
+	if size < 1 {
+		return board, size, fmt.Errorf("image %v is too small to hold a board", bounds)
+	}
+	return board, size, nil
+}
+
+func (cfg *PieceFinderConfig) ranks() int {
+	if cfg.Ranks <= 0 {
+		return 8
+	}
+	return cfg.Ranks
+}
+
+func (cfg *PieceFinderConfig) files() int {
+	if cfg.Files <= 0 {
+		return 8
+	}
+	return cfg.Files
+}
+
+func (cfg *PieceFinderConfig) hsv() bool {
+	return cfg.ColorMode == "hsv"
+}
+
+// rotated is if the board is turned 180 degrees from the default, white at the bottom of the image
+func (cfg *PieceFinderConfig) rotated() bool {
+	return cfg.WhiteSide == "bottom"
+}
+
+// pieceType is the piece whose height is closest to how tall this one is
+func (cfg *PieceFinderConfig) pieceType(height float64) string {
+	heights := cfg.PieceHeights
+	if len(heights) == 0 {
+		heights = defaultPieceHeights
+	}
+
+	best, bestDiff := "", math.Inf(1)
+	for _, t := range []string{"P", "R", "N", "B", "Q", "K"} {
+		h, ok := heights[t]
+		if !ok {
+			continue
+		}
+		if diff := math.Abs(h - height); diff < bestDiff {
+			best, bestDiff = t, diff
+		}
+	}
+	return best
 }
 
 func (cfg *PieceFinderConfig) Validate(path string) ([]string, []string, error) {
 	if cfg.Input == "" {
 		return nil, nil, fmt.Errorf("need an input")
 	}
+	if cfg.MinPieceSize < 0 {
+		return nil, nil, fmt.Errorf("min-piece-size has to be positive, not %v", cfg.MinPieceSize)
+	}
+	if cfg.ColorThreshold < 0 || cfg.ColorThreshold > 255 {
+		return nil, nil, fmt.Errorf("color-threshold has to be between 0 and 255, not %v", cfg.ColorThreshold)
+	}
+	if len(cfg.ColorWeights) > 0 {
+		if len(cfg.ColorWeights) != 3 {
+			return nil, nil, fmt.Errorf("color-weights needs 3 values (r, g, b), not %d", len(cfg.ColorWeights))
+		}
+		if cfg.ColorWeights[0] < 0 || cfg.ColorWeights[1] < 0 || cfg.ColorWeights[2] < 0 ||
+			cfg.ColorWeights[0]+cfg.ColorWeights[1]+cfg.ColorWeights[2] <= 0 {
+			return nil, nil, fmt.Errorf("color-weights can't be negative or all 0")
+		}
+	}
+	if cfg.ColorMode != "" && cfg.ColorMode != "brightness" && cfg.ColorMode != "hsv" {
+		return nil, nil, fmt.Errorf("color-mode has to be brightness or hsv, not %s", cfg.ColorMode)
+	}
+	if cfg.WhiteSide != "" && cfg.WhiteSide != "top" && cfg.WhiteSide != "bottom" {
+		return nil, nil, fmt.Errorf("white-side has to be top or bottom, not %s", cfg.WhiteSide)
+	}
+	if cfg.ToppledHeight < 0 {
+		return nil, nil, fmt.Errorf("toppled-height has to be positive, not %v", cfg.ToppledHeight)
+	}
+	if cfg.Ranks < 0 || cfg.Ranks > 9 {
+		return nil, nil, fmt.Errorf("ranks has to be between 1 and 9, not %d", cfg.Ranks)
+	}
+	if cfg.Files < 0 || cfg.Files > 26 {
+		return nil, nil, fmt.Errorf("files has to be between 1 and 26, not %d", cfg.Files)
+	}
+	if len(cfg.BoardBounds) > 0 {
+		b := cfg.BoardBounds
+		if len(b) != 4 {
+			return nil, nil, fmt.Errorf("board-bounds needs 4 values (x0, y0, x1, y1), not %d", len(b))
+		}
+		if b[0] < 0 || b[1] < 0 || b[2] <= b[0] || b[3] <= b[1] {
+			return nil, nil, fmt.Errorf("board-bounds %v isn't a rectangle with x0 < x1 and y0 < y1", b)
+		}
+		if b[2]-b[0] < cfg.files() || b[3]-b[1] < cfg.ranks() {
+			return nil, nil, fmt.Errorf("board-bounds %v is too small for %d files by %d ranks", b, cfg.files(), cfg.ranks())
+		}
+	}
+	for t, h := range cfg.PieceHeights {
+		if _, ok := defaultPieceHeights[t]; !ok {
+			return nil, nil, fmt.Errorf("piece-heights has unknown piece %s, needs to be one of P N B R Q K", t)
+		}
+		if h <= 0 {
+			return nil, nil, fmt.Errorf("piece-heights for %s has to be positive, not %v", t, h)
+		}
+	}
 	return []string{cfg.Input}, nil, nil
 }
 
@@ -84,6 +333,10 @@ func NewPieceFinder(ctx context.Context, deps resource.Dependencies, name resour
 		logger.Errorf("can't get framesystem: %v", err)
 	}
 
+	if conf.ColorThreshold <= 0 {
+		logger.Warnf("no color-threshold in the config, using %0.0f until calibrate_color is run", conf.colorThreshold())
+	}
+
 	return bc, nil
 }
 
@@ -98,8 +351,15 @@ type PieceFinder struct {
 	rfs   framesystem.Service
 	input camera.Camera
 	props camera.Properties
+
+	calibrationLock     sync.Mutex
+	calibratedThreshold float64            // from calibrate_color, 0 if not calibrated
+	emptyBaseline       map[string]float64 // from calibrate_empty, nil if not calibrated
 }
 
+// indexed by squareInfo.color
+var pieceColorNames = []string{"", "W", "B"}
+
 type squareInfo struct {
 	rank int
 	file rune
@@ -109,29 +369,36 @@ type squareInfo struct {
 
 	color int // 0,1,2
 
+	pieceHeight float64 // mm above the board
+	pieceType   string  // P N B R Q K by height, empty if there's no piece
+	confidence  float64 // 0-1, near 0 is worth capturing again
+	problem     string  // "toppled" or "off-grid" if a person should fix the square before the arm touches it
+
 	pc pointcloud.PointCloud
 }
 
-func BoardDebugImageHack(srcImg image.Image, pc pointcloud.PointCloud, props camera.Properties) (image.Image, []squareInfo, error) {
-	dst := image.NewRGBA(image.Rect(0, 0, srcImg.Bounds().Max.Y, srcImg.Bounds().Max.Y))
-
-	xOffset := (srcImg.Bounds().Max.X - srcImg.Bounds().Max.Y) / 2
+func BoardDebugImageHack(srcImg image.Image, pc pointcloud.PointCloud, props camera.Properties, conf *PieceFinderConfig) (image.Image, []squareInfo, error) {
+	board, squareSize, err := conf.boardRect(srcImg.Bounds())
+	if err != nil {
+		return nil, nil, err
+	}
+	xOffset, yOffset := board.Min.X, board.Min.Y
 
-	squareSize := srcImg.Bounds().Max.Y / 8
+	dst := image.NewRGBA(image.Rect(0, 0, board.Dx(), board.Dy()))
 
 	squares := []squareInfo{}
 
-	for rank := 1; rank <= 8; rank++ {
-		for file := 'a'; file <= 'h'; file++ {
-			xStartOffset := int(('h' - file)) * squareSize
-			yStartOffset := (rank - 1) * squareSize
+	lastFile := 'a' + rune(conf.files()-1)
+	for rank := 1; rank <= conf.ranks(); rank++ {
+		for file := 'a'; file <= lastFile; file++ {
+			xStartOffset, yStartOffset := squareOffset(rank, file, squareSize, conf.ranks(), conf.files(), conf.rotated())
 
 			srcRect := image.Rect(
 				xStartOffset+xOffset,
-				yStartOffset,
+				yStartOffset+yOffset,
 				xStartOffset+xOffset+squareSize,
-				yStartOffset+squareSize,
-			)
+				yStartOffset+yOffset+squareSize,
+			).Intersect(srcImg.Bounds())
 
 			dstRect := image.Rect(
 				xStartOffset,
@@ -147,16 +414,29 @@ func BoardDebugImageHack(srcImg image.Image, pc pointcloud.PointCloud, props cam
 
 			name := fmt.Sprintf("%s%d", string([]byte{byte(file)}), rank)
 
-			pieceColor := estimatePieceColor(subPc)
-			colorNames := []string{"", "W", "B"}
-			meta := colorNames[pieceColor]
+			pieceColor := 0
+			pieceType := ""
+			height := heightAboveBaseline(subPc, name, conf)
+			if height >= conf.emptyHeight() {
+				pieceColor = estimatePieceColor(subPc, conf)
+			}
+			if pieceColor != 0 {
+				pieceType = conf.pieceType(height)
+			}
+			meta := pieceColorNames[pieceColor] + pieceType
+			confidence := squareConfidence(subPc, height, pieceColor, conf)
+			problem := pieceProblem(subPc, height, conf)
 
 			draw.Draw(dst, dstRect, srcImg, srcRect.Min, draw.Src)
 
-			// put name in the middle of that square
+			// put name in the middle of that square, and how sure we are under it
 			textX := dstRect.Min.X + squareSize/2 - len(name)*3
 			textY := dstRect.Min.Y + squareSize/2 + 3
 			drawString(dst, textX, textY, name+"-"+meta, color.RGBA{255, 0, 0, 255})
+			drawString(dst, textX, textY+12, fmt.Sprintf("%0.2f", confidence), color.RGBA{255, 0, 0, 255})
+			if problem != "" {
+				drawString(dst, textX, textY+24, problem, color.RGBA{255, 255, 0, 255})
+			}
 
 			squares = append(squares, squareInfo{
 				rank,
@@ -164,6 +444,10 @@ func BoardDebugImageHack(srcImg image.Image, pc pointcloud.PointCloud, props cam
 				name,
 				srcRect,
 				pieceColor,
+				height,
+				pieceType,
+				confidence,
+				problem,
 				subPc,
 			})
 		}
@@ -172,40 +456,317 @@ func BoardDebugImageHack(srcImg image.Image, pc pointcloud.PointCloud, props cam
 	return dst, squares, nil
 }
 
-// 0 - blank, 1 - white, 2 - black
-func estimatePieceColor(pc pointcloud.PointCloud) int {
-	minZ := pc.MetaData().MaxZ - minPieceSize
-	var totalR, totalG, totalB float64
-	count := 0
+// boardFEN is the piece placement part of a FEN for what the camera sees.
+// Piece types are guesses from their height, the colors are what to trust.
+func boardFEN(squares []squareInfo) string {
+	board := map[string]squareInfo{}
+	ranks, lastFile := 0, 'a'
+	for _, sq := range squares {
+		board[sq.name] = sq
+		ranks = max(ranks, sq.rank)
+		lastFile = max(lastFile, sq.file)
+	}
+
+	sb := strings.Builder{}
+	for rank := ranks; rank >= 1; rank-- {
+		empty := 0
+		for file := 'a'; file <= lastFile; file++ {
+			sq := board[fmt.Sprintf("%c%d", file, rank)]
+			if sq.color == 0 {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				sb.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			p := sq.pieceType
+			if p == "" {
+				p = "P"
+			}
+			if sq.color == 2 {
+				p = strings.ToLower(p)
+			}
+			sb.WriteString(p)
+		}
+		if empty > 0 {
+			sb.WriteString(strconv.Itoa(empty))
+		}
+		if rank > 1 {
+			sb.WriteString("/")
+		}
+	}
+	return sb.String()
+}
+
+// squareHeights is how far the tallest thing on each square sticks up above the board, in mm
+func squareHeights(squares []squareInfo) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, sq := range squares {
+		ret[sq.name] = sq.pieceHeight
+	}
+	return ret
+}
+
+// squareProblems is every square with something a person should fix, e.g. {"d4": "toppled"}
+func squareProblems(squares []squareInfo) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, sq := range squares {
+		if sq.problem != "" {
+			ret[sq.name] = sq.problem
+		}
+	}
+	return ret
+}
+
+// squareOffset is where a square starts in the cropped board image.
+// By default a1 is top right and the last square, h8 on a normal board, bottom left, rotated swaps them.
+func squareOffset(rank int, file rune, squareSize, ranks, files int, rotated bool) (int, int) {
+	x := (files - 1 - int(file-'a')) * squareSize
+	y := (rank - 1) * squareSize
+	if rotated {
+		x = int(file-'a') * squareSize
+		y = (ranks - rank) * squareSize
+	}
+	return x, y
+}
+
+// squareHeight is how far the tallest thing in the square sticks up above the board.
+// The camera looks down, so the board is the far end of the depths and the top of a piece the near end.
+func squareHeight(pc pointcloud.PointCloud) float64 {
+	board, top, ok := squareDepths(pc)
+	if !ok {
+		return 0
+	}
+	return board - top
+}
 
+// squareDepths is how far the camera is from the board and from the top of whatever is on it, false if there are no points
+func squareDepths(pc pointcloud.PointCloud) (float64, float64, bool) {
+	depths := []float64{}
 	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
-		if p.Z < minZ && d != nil && d.HasColor() {
-			r, g, b := d.RGB255()
-			totalR += float64(r)
-			totalG += float64(g)
-			totalB += float64(b)
-			count++
+		depths = append(depths, p.Z)
+		return true
+	})
+
+	if len(depths) == 0 {
+		return 0, 0, false
+	}
+
+	slices.Sort(depths)
+
+	// percentiles rather than min/max so a few noisy points don't matter
+	board := depths[len(depths)*9/10]
+	top := depths[len(depths)/50]
+
+	return board, top, true
+}
+
+// heightAboveBaseline is squareHeight, but measured from the empty board when there is a baseline for the square,
+// so a piece covering the whole square, or a shiny square, doesn't fool it
+func heightAboveBaseline(pc pointcloud.PointCloud, name string, conf *PieceFinderConfig) float64 {
+	board, ok := conf.EmptyBaseline[name]
+	if !ok {
+		return squareHeight(pc)
+	}
+	_, top, ok := squareDepths(pc)
+	if !ok {
+		return 0
+	}
+	return board - top
+}
+
+// emptyBaseline is the board depth of every square, failing if any of them has something on it
+func emptyBaseline(squares []squareInfo, conf *PieceFinderConfig) (map[string]float64, error) {
+	baseline := map[string]float64{}
+	for _, sq := range squares {
+		board, top, ok := squareDepths(sq.pc)
+		if !ok {
+			return nil, fmt.Errorf("no points for %s, can't use it as a baseline", sq.name)
+		}
+		if board-top >= conf.emptyHeight() {
+			return nil, fmt.Errorf("%s isn't empty, clear the board first", sq.name)
+		}
+		baseline[sq.name] = board
+	}
+	return baseline, nil
+}
+
+// pieceProblem is "toppled" if what's on the square is too short to be a standing piece,
+// "off-grid" if its top is well away from the middle of the square, which is what a piece
+// knocked onto a line between two squares looks like from either side, and empty if it looks fine
+func pieceProblem(pc pointcloud.PointCloud, height float64, conf *PieceFinderConfig) string {
+	if height < conf.emptyHeight() {
+		return ""
+	}
+	if height < conf.toppledHeight() {
+		return "toppled"
+	}
+
+	_, top, ok := squareDepths(pc)
+	if !ok {
+		return ""
+	}
+
+	// the upper half of the piece, so a wide base doesn't pull it toward the middle
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	var head r3.Vector
+	n := 0
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		minX, minY = min(minX, p.X), min(minY, p.Y)
+		maxX, maxY = max(maxX, p.X), max(maxY, p.Y)
+		if p.Z <= top+height/2 {
+			head = head.Add(p)
+			n++
 		}
 		return true
 	})
+	if n == 0 {
+		return ""
+	}
+	head = head.Mul(1 / float64(n))
 
-	if count <= 10 {
-		return 0 // blank - no piece detected
+	size := max(maxX-minX, maxY-minY)
+	off := math.Hypot(head.X-(minX+maxX)/2, head.Y-(minY+maxY)/2)
+	if off > size*.3 {
+		return "off-grid"
+	}
+	return ""
+}
+
+// squareConfidence is how sure the call on a square is, from how far its height and brightness
+// are from the thresholds and how many points there were to go on
+func squareConfidence(pc pointcloud.PointCloud, height float64, pieceColor int, conf *PieceFinderConfig) float64 {
+	if pieceColor == 0 {
+		// tall enough for a piece but no color to go on is a guess either way
+		return clamp01((conf.emptyHeight() - height) / conf.emptyHeight())
 	}
 
-	// calculate average brightness
-	avgR := totalR / float64(count)
-	avgG := totalG / float64(count)
-	avgB := totalB / float64(count)
-	brightness := (avgR + avgG + avgB) / 3.0
+	count := 0
+	pieceTop(pc, conf, func(r, g, b uint8) { count++ })
+	brightness, _ := pieceBrightness(pc, conf)
+
+	return min(
+		clamp01((height-conf.emptyHeight())/conf.emptyHeight()),
+		clamp01(math.Abs(brightness-conf.colorThreshold())/64),
+		clamp01(float64(count)/float64(4*conf.minPresencePoints())),
+	)
+}
+
+func clamp01(x float64) float64 {
+	return max(0, min(1, x))
+}
+
+// 0 - blank, 1 - white, 2 - black
+func estimatePieceColor(pc pointcloud.PointCloud, conf *PieceFinderConfig) int {
+	brightness, ok := pieceBrightness(pc, conf)
+	if !ok {
+		return 0 // blank - no piece detected
+	}
 
 	// threshold to distinguish white vs black pieces
-	if brightness > 128 {
+	if brightness > conf.colorThreshold() {
 		return 1 // white
 	}
 	return 2 // black
 }
 
+// pieceBrightness is the brightness of the top of the piece, false if there aren't enough points for a piece
+func pieceBrightness(pc pointcloud.PointCloud, conf *PieceFinderConfig) (float64, bool) {
+	if conf.hsv() {
+		_, sat, val, ok := pieceHSV(pc, conf)
+		return 255 * val * (1 - sat), ok
+	}
+
+	values := []float64{}
+	pieceTop(pc, conf, func(r, g, b uint8) {
+		values = append(values, conf.brightness(float64(r), float64(g), float64(b)))
+	})
+
+	if len(values) <= conf.minPresencePoints() {
+		return 0, false
+	}
+
+	return trimmedMean(values, 0.1), true
+}
+
+// pieceHSV is the hue (degrees), saturation and value (0-1) of the top of the piece
+func pieceHSV(pc pointcloud.PointCloud, conf *PieceFinderConfig) (float64, float64, float64, bool) {
+	hues, sats, vals := []float64{}, []float64{}, []float64{}
+	pieceTop(pc, conf, func(r, g, b uint8) {
+		h, s, v := rimage.NewColor(r, g, b).HsvNormal()
+		hues = append(hues, h)
+		sats = append(sats, s)
+		vals = append(vals, v)
+	})
+
+	if len(hues) <= conf.minPresencePoints() {
+		return 0, 0, 0, false
+	}
+
+	// hue wraps at red, but pieces that matter here are white, black or wood, nowhere near it
+	return trimmedMean(hues, 0.1), trimmedMean(sats, 0.1), trimmedMean(vals, 0.1), true
+}
+
+// pieceTop calls fn with the color of every point high enough up to be the piece rather than the board
+func pieceTop(pc pointcloud.PointCloud, conf *PieceFinderConfig, fn func(r, g, b uint8)) {
+	minZ := pc.MetaData().MaxZ - conf.minPieceSize()
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		if p.Z < minZ && d != nil && d.HasColor() {
+			fn(d.RGB255())
+		}
+		return true
+	})
+}
+
+// trimmedMean drops the top and bottom trim of the values before averaging,
+// so glare on a black piece or a bit of board next to a white one don't swing it
+func trimmedMean(values []float64, trim float64) float64 {
+	slices.Sort(values)
+	drop := int(float64(len(values)) * trim)
+	values = values[drop : len(values)-drop]
+
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total / float64(len(values))
+}
+
+// calibrateThreshold splits the difference between the darkest white piece and the brightest black one,
+// with the board in the starting position, white on the first two ranks and black on the last two
+// (one each on a board with only 2 or 3 ranks)
+func calibrateThreshold(squares []squareInfo, conf *PieceFinderConfig) (float64, error) {
+	back := min(2, conf.ranks()/2)
+	if back == 0 {
+		return 0, fmt.Errorf("need at least 2 ranks to calibrate, have %d", conf.ranks())
+	}
+
+	darkestWhite, brightestBlack := math.Inf(1), math.Inf(-1)
+	for _, sq := range squares {
+		b, ok := pieceBrightness(sq.pc, conf)
+		ok = ok && sq.color != 0
+		switch {
+		case sq.rank <= back:
+			if !ok {
+				return 0, fmt.Errorf("no white piece found on %s, is the board set up?", sq.name)
+			}
+			darkestWhite = min(darkestWhite, b)
+		case sq.rank > conf.ranks()-back:
+			if !ok {
+				return 0, fmt.Errorf("no black piece found on %s, is the board set up?", sq.name)
+			}
+			brightestBlack = max(brightestBlack, b)
+		}
+	}
+
+	if darkestWhite <= brightestBlack {
+		return 0, fmt.Errorf("can't separate white from black, darkest white is %0.1f and brightest black %0.1f, try color-weights",
+			darkestWhite, brightestBlack)
+	}
+	return (darkestWhite + brightestBlack) / 2, nil
+}
+
 func drawString(dst *image.RGBA, x, y int, s string, c color.Color) {
 	d := &font.Drawer{
 		Dst:  dst,
@@ -217,7 +778,89 @@ func drawString(dst *image.RGBA, x, y int, s string, c color.Color) {
 }
 
 func (bc *PieceFinder) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
-	return nil, fmt.Errorf("DoCommand not supported")
+	if cmd["calibrate_color"] == true {
+		_, _, squares, err := bc.capture(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		threshold, err := calibrateThreshold(squares, bc.currentConf())
+		if err != nil {
+			return nil, err
+		}
+
+		bc.calibrationLock.Lock()
+		bc.calibratedThreshold = threshold
+		bc.calibrationLock.Unlock()
+
+		bc.logger.Infof("calibrated color-threshold: %0.1f, add it to the config to keep it", threshold)
+		return map[string]interface{}{"color-threshold": threshold}, nil
+	}
+	if cmd["calibrate_empty"] == true {
+		_, _, squares, err := bc.capture(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		baseline, err := emptyBaseline(squares, bc.conf)
+		if err != nil {
+			return nil, err
+		}
+
+		bc.calibrationLock.Lock()
+		bc.emptyBaseline = baseline
+		bc.calibrationLock.Unlock()
+
+		bc.logger.Infof("calibrated empty board for %d squares, add the returned empty-baseline to the config to keep it", len(baseline))
+		ret := map[string]interface{}{}
+		for name, board := range baseline {
+			ret[name] = board
+		}
+		return map[string]interface{}{"squares": len(baseline), "empty-baseline": ret}, nil
+	}
+	if cmd["debug_image"] == true {
+		_, dst, _, err := bc.capture(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.Buffer{}
+		err = jpeg.Encode(&buf, dst, nil)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"image":     base64.StdEncoding.EncodeToString(buf.Bytes()),
+			"mime_type": "image/jpeg",
+		}, nil
+	}
+	if cmd["heights"] == true {
+		vc, err := bc.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"heights": vc.Extra["heights"], "top_z": vc.Extra["top_z"]}, nil
+	}
+	if cmd["fen"] == true {
+		_, _, squares, err := bc.capture(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"fen": boardFEN(squares)}, nil
+	}
+	return nil, fmt.Errorf("bad cmd %v", cmd)
+}
+
+// currentConf is the config with any calibration in place, it's a copy so it's safe to use while calibrating
+func (bc *PieceFinder) currentConf() *PieceFinderConfig {
+	bc.calibrationLock.Lock()
+	defer bc.calibrationLock.Unlock()
+
+	conf := *bc.conf
+	if bc.calibratedThreshold > 0 {
+		conf.ColorThreshold = bc.calibratedThreshold
+	}
+	if bc.emptyBaseline != nil {
+		conf.EmptyBaseline = bc.emptyBaseline
+	}
+	return &conf
 }
 
 func (bc *PieceFinder) Name() resource.Name {
@@ -225,11 +868,51 @@ func (bc *PieceFinder) Name() resource.Name {
 }
 
 func (bc *PieceFinder) DetectionsFromCamera(ctx context.Context, cameraName string, extra map[string]interface{}) ([]objectdetection.Detection, error) {
-	return nil, fmt.Errorf("DetectionsFromCamera not implemented")
+	img, _, squares, err := bc.capture(ctx, extra)
+	if err != nil {
+		return nil, err
+	}
+	return squareDetections(img, squares), nil
 }
 
+// Detections uses the given image, but still needs a point cloud from the input to tell what's on each square
 func (bc *PieceFinder) Detections(ctx context.Context, img image.Image, extra map[string]interface{}) ([]objectdetection.Detection, error) {
-	return nil, fmt.Errorf("Detections not implemented")
+	pc, err := bc.input.NextPointCloud(ctx, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	_, squares, err := BoardDebugImageHack(img, pc, bc.props, bc.currentConf())
+	if err != nil {
+		return nil, err
+	}
+	return squareDetections(img, squares), nil
+}
+
+// squareDetections is a detection for every square with a piece on it, labeled like e4-W
+func squareDetections(img image.Image, squares []squareInfo) []objectdetection.Detection {
+	ret := []objectdetection.Detection{}
+	for _, s := range squares {
+		if s.color == 0 {
+			continue
+		}
+		label := s.name + "-" + pieceColorNames[s.color]
+		ret = append(ret, objectdetection.NewDetection(img.Bounds(), s.originalBounds, s.confidence, label))
+	}
+	return ret
+}
+
+// splitConfidence splits an object label like e4-1-Q@0.87 into e4-1-Q and 0.87, labels without a confidence are sure
+func splitConfidence(label string) (string, float64) {
+	label, c, ok := strings.Cut(label, "@")
+	if !ok {
+		return label, 1
+	}
+	confidence, err := strconv.ParseFloat(c, 64)
+	if err != nil {
+		return label, 0
+	}
+	return label, confidence
 }
 
 func (bc *PieceFinder) ClassificationsFromCamera(ctx context.Context, cameraName string, n int, extra map[string]interface{}) (classification.Classifications, error) {
@@ -252,35 +935,17 @@ func (bc *PieceFinder) CaptureAllFromCamera(ctx context.Context, cameraName stri
 
 	ret := viscapture.VisCapture{}
 
-	ni, _, err := bc.input.Images(ctx, nil, extra)
+	img, _, squares, err := bc.capture(ctx, extra)
 	if err != nil {
 		return ret, err
 	}
-
-	pc, err := bc.input.NextPointCloud(ctx, extra)
-	if err != nil {
-		return ret, err
-	}
-
-	if len(ni) == 0 {
-		return ret, fmt.Errorf("no images returned from input camera")
-	}
-
-	ret.Image, err = ni[0].Image(ctx)
-	if err != nil {
-		return ret, err
-	}
-
-	dst, squares, err := BoardDebugImageHack(ret.Image, pc, bc.props)
-	if err != nil {
-		return ret, err
-	}
-
-	if extra["printdst"] == true {
-		err := rimage.WriteImageToFile("hack-test.jpg", dst)
-		if err != nil {
-			bc.logger.Warnf("Writing file failed: %v", err)
-		}
+	ret.Image = img
+	topZ := map[string]interface{}{}
+	ret.Extra = map[string]interface{}{
+		"fen":      boardFEN(squares),
+		"heights":  squareHeights(squares),
+		"top_z":    topZ,
+		"problems": squareProblems(squares),
 	}
 
 	ret.Objects = []*viz.Object{}
@@ -291,15 +956,21 @@ func (bc *PieceFinder) CaptureAllFromCamera(ctx context.Context, cameraName stri
 		if err != nil {
 			return ret, err
 		}
+		if pc.Size() > 0 {
+			topZ[s.name] = pc.MetaData().MaxZ
+		}
 
 		label := fmt.Sprintf("%s-%d", s.name, s.color)
-		o, err := viz.NewObjectWithLabel(pc, label, nil)
+		if s.pieceType != "" {
+			label += "-" + s.pieceType
+		}
+		o, err := viz.NewObjectWithLabel(pc, fmt.Sprintf("%s@%0.2f", label, s.confidence), nil)
 		if err != nil {
 			return ret, err
 		}
 		ret.Objects = append(ret.Objects, o)
 
-		ret.Detections = append(ret.Detections, objectdetection.NewDetectionWithoutImgBounds(s.originalBounds, 1, label))
+		ret.Detections = append(ret.Detections, objectdetection.NewDetectionWithoutImgBounds(s.originalBounds, s.confidence, label))
 
 		lowPoint := touch.PCFindLowestInRegion(s.pc, image.Rect(-10000, -10000, 10000, 10000))
 
@@ -319,8 +990,92 @@ func (bc *PieceFinder) CaptureAllFromCamera(ctx context.Context, cameraName stri
 	return ret, nil
 }
 
+// capture gets an image and point cloud from the input and splits them into squares, also returning the labeled debug image
+func (bc *PieceFinder) capture(ctx context.Context, extra map[string]interface{}) (image.Image, image.Image, []squareInfo, error) {
+	ni, _, err := bc.input.Images(ctx, nil, extra)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pc, err := bc.input.NextPointCloud(ctx, extra)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(ni) == 0 {
+		return nil, nil, nil, fmt.Errorf("no images returned from input camera")
+	}
+
+	img, err := bc.decodeImage(ctx, ni)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conf := bc.currentConf()
+	dst, squares, err := BoardDebugImageHack(img, pc, bc.props, conf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if extra["printdst"] == true {
+		err := bc.writeDebugImage(dst)
+		if err != nil {
+			bc.logger.Warnf("Writing file failed: %v", err)
+		}
+	}
+
+	// from the same conf as the capture, so it has the calibrated threshold and baseline
+	if conf.hsv() {
+		for _, sq := range squares {
+			if sq.color == 0 {
+				continue
+			}
+			h, sat, val, _ := pieceHSV(sq.pc, conf)
+			bc.logger.Debugf("%s hue: %0.0f saturation: %0.2f value: %0.2f threshold: %0.0f -> %s",
+				sq.name, h, sat, val, conf.colorThreshold(), pieceColorNames[sq.color])
+		}
+	}
+
+	return img, dst, squares, nil
+}
+
+func (bc *PieceFinder) writeDebugImage(dst image.Image) error {
+	if bc.conf.DebugImageDir != "" {
+		err := os.MkdirAll(bc.conf.DebugImageDir, 0o755)
+		if err != nil {
+			return err
+		}
+	}
+	return rimage.WriteImageToFile(bc.conf.debugImage(time.Now()), dst)
+}
+
+// decodeImage retries each lazy image a few times, backing off between tries, then moves on to the next source
+func (bc *PieceFinder) decodeImage(ctx context.Context, ni []camera.NamedImage) (image.Image, error) {
+	var lastErr error
+	for _, n := range ni {
+		backoff := imageRetryBackoff
+		for attempt := 0; attempt <= bc.conf.imageRetries(); attempt++ {
+			if attempt > 0 {
+				if err := sleep(ctx, backoff); err != nil {
+					return nil, err
+				}
+				backoff *= 2
+			}
+			img, err := n.Image(ctx)
+			if err == nil {
+				bc.logger.Debugf("using image from source: %s", n.SourceName)
+				return img, nil
+			}
+			lastErr = err
+			bc.logger.Warnf("can't decode image from source %s (attempt %d): %v", n.SourceName, attempt, err)
+		}
+	}
+	return nil, fmt.Errorf("can't decode any of %d images: %w", len(ni), lastErr)
+}
+
 func (bc *PieceFinder) GetProperties(ctx context.Context, extra map[string]interface{}) (*vision.Properties, error) {
 	return &vision.Properties{
+		DetectionSupported:  true,
 		ObjectPCDsSupported: true,
 	}, nil
 }
@@ -1,10 +1,23 @@
 package viamchess
 
 import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/golang/geo/r3"
+
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/data"
+	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/pointcloud"
 	"go.viam.com/rdk/rimage"
+	"go.viam.com/rdk/utils"
 	"go.viam.com/test"
 
 	"github.com/erh/vmodutils/touch"
@@ -17,10 +30,420 @@ func TestPieceFinder1(t *testing.T) {
 	pc, err := pointcloud.NewFromFile("data/hack1.pcd", "")
 	test.That(t, err, test.ShouldBeNil)
 
-	out, _, err := BoardDebugImageHack(input, pc, touch.RealSenseProperties)
+	out, _, err := BoardDebugImageHack(input, pc, touch.RealSenseProperties, &PieceFinderConfig{})
+	test.That(t, err, test.ShouldBeNil)
+
+	err = rimage.WriteImageToFile(filepath.Join(t.TempDir(), "hack-test.jpg"), out)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestSquareHeight(t *testing.T) {
+	empty := pointcloud.NewBasicEmpty()
+	full := pointcloud.NewBasicEmpty()
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			p := r3.Vector{float64(x), float64(y), 500}
+			test.That(t, empty.Set(p, nil), test.ShouldBeNil)
+			if x < 4 && y < 4 {
+				p.Z = 460
+			}
+			test.That(t, full.Set(p, nil), test.ShouldBeNil)
+		}
+	}
+
+	test.That(t, squareHeight(empty), test.ShouldAlmostEqual, 0)
+	test.That(t, squareHeight(full), test.ShouldAlmostEqual, 40)
+	test.That(t, squareHeight(pointcloud.NewBasicEmpty()), test.ShouldAlmostEqual, 0)
+}
+
+func TestSquareOffsetRotated(t *testing.T) {
+	x, y := squareOffset(1, 'a', 10, 8, 8, false)
+	test.That(t, x, test.ShouldEqual, 70)
+	test.That(t, y, test.ShouldEqual, 0)
+
+	x, y = squareOffset(8, 'h', 10, 8, 8, false)
+	test.That(t, x, test.ShouldEqual, 0)
+	test.That(t, y, test.ShouldEqual, 70)
+
+	// turned 180 degrees every square lands where its mirror through the center was
+	for rank := 1; rank <= 8; rank++ {
+		for file := 'a'; file <= 'h'; file++ {
+			x, y := squareOffset(rank, file, 10, 8, 8, true)
+			mx, my := squareOffset(9-rank, 'a'+'h'-file, 10, 8, 8, false)
+			test.That(t, x, test.ShouldEqual, mx)
+			test.That(t, y, test.ShouldEqual, my)
+		}
+	}
+}
+
+func TestBrightness(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+	test.That(t, cfg.brightness(200, 150, 40), test.ShouldAlmostEqual, 130)
+	test.That(t, cfg.colorThreshold(), test.ShouldEqual, 128)
+
+	cfg.ColorWeights = []float64{1, 1, 0}
+	test.That(t, cfg.brightness(200, 150, 40), test.ShouldAlmostEqual, 175)
+
+	cfg.ColorWeights = []float64{1, 1}
+	cfg.Input = "cam"
+	_, _, err := cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func pieceCloud(t *testing.T, brightness uint8) pointcloud.PointCloud {
+	return pieceCloudRGB(t, brightness, brightness, brightness)
+}
+
+func pieceCloudRGB(t *testing.T, r, g, b uint8) pointcloud.PointCloud {
+	pc := pointcloud.NewBasicEmpty()
+	c := pointcloud.NewColoredData(color.NRGBA{r, g, b, 255})
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			p := r3.Vector{float64(x), float64(y), 500}
+			if x < 4 && y < 4 {
+				p.Z = 450
+			}
+			test.That(t, pc.Set(p, c), test.ShouldBeNil)
+		}
+	}
+	return pc
+}
+
+func TestCalibrateThreshold(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+
+	b, ok := pieceBrightness(pieceCloud(t, 200), cfg)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, b, test.ShouldAlmostEqual, 200)
+
+	// the piece in pieceCloud is only 16 points
+	_, ok = pieceBrightness(pieceCloud(t, 200), &PieceFinderConfig{MinPresencePoints: 16})
+	test.That(t, ok, test.ShouldBeFalse)
+
+	squares := []squareInfo{
+		{rank: 1, name: "a1", color: 1, pc: pieceCloud(t, 200)},
+		{rank: 2, name: "a2", color: 1, pc: pieceCloud(t, 160)},
+		{rank: 4, name: "a4", pc: pointcloud.NewBasicEmpty()},
+		{rank: 7, name: "a7", color: 2, pc: pieceCloud(t, 40)},
+		{rank: 8, name: "a8", color: 2, pc: pieceCloud(t, 60)},
+	}
+	threshold, err := calibrateThreshold(squares, cfg)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, threshold, test.ShouldAlmostEqual, 110)
+
+	squares[3].pc = pieceCloud(t, 170)
+	_, err = calibrateThreshold(squares, cfg)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	squares[1].color = 0
+	_, err = calibrateThreshold(squares, cfg)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "a2")
+
+	// a 4 rank demo board has black on ranks 3 and 4
+	small := []squareInfo{
+		{rank: 1, name: "a1", color: 1, pc: pieceCloud(t, 200)},
+		{rank: 2, name: "a2", color: 1, pc: pieceCloud(t, 160)},
+		{rank: 3, name: "a3", color: 2, pc: pieceCloud(t, 40)},
+		{rank: 4, name: "a4", color: 2, pc: pieceCloud(t, 60)},
+	}
+	threshold, err = calibrateThreshold(small, &PieceFinderConfig{Ranks: 4})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, threshold, test.ShouldAlmostEqual, 110)
+
+	// and with 3, one rank each and nothing in the middle
+	three := []squareInfo{
+		{rank: 1, name: "a1", color: 1, pc: pieceCloud(t, 200)},
+		{rank: 2, name: "a2", pc: pointcloud.NewBasicEmpty()},
+		{rank: 3, name: "a3", color: 2, pc: pieceCloud(t, 60)},
+	}
+	threshold, err = calibrateThreshold(three, &PieceFinderConfig{Ranks: 3})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, threshold, test.ShouldAlmostEqual, 130)
+
+	_, err = calibrateThreshold(small, &PieceFinderConfig{Ranks: 1})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestPieceType(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+	test.That(t, cfg.pieceType(48), test.ShouldEqual, "P")
+	test.That(t, cfg.pieceType(88), test.ShouldEqual, "Q")
+	test.That(t, cfg.pieceType(120), test.ShouldEqual, "K")
+
+	// a short set
+	cfg.PieceHeights = map[string]float64{"P": 30, "R": 35, "N": 40, "B": 45, "Q": 55, "K": 60}
+	test.That(t, cfg.pieceType(48), test.ShouldEqual, "B")
+
+	cfg.Input = "cam"
+	cfg.PieceHeights["X"] = 10
+	_, _, err := cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestBoardFEN(t *testing.T) {
+	squares := []squareInfo{}
+	for rank := 1; rank <= 8; rank++ {
+		for file := 'a'; file <= 'h'; file++ {
+			sq := squareInfo{rank: rank, file: file, name: fmt.Sprintf("%c%d", file, rank)}
+			switch rank {
+			case 1:
+				sq.color, sq.pieceType = 1, "R"
+			case 2:
+				sq.color, sq.pieceType = 1, "P"
+			case 7:
+				sq.color, sq.pieceType = 2, "P"
+			case 8:
+				sq.color, sq.pieceType = 2, "Q"
+			}
+			squares = append(squares, sq)
+		}
+	}
+	squares[12].color = 0                             // e2
+	squares[28].color, squares[28].pieceType = 1, "P" // e4
+
+	test.That(t, boardFEN(squares), test.ShouldEqual, "qqqqqqqq/pppppppp/8/8/4P3/8/PPPP1PPP/RRRRRRRR")
+}
+
+func TestSquareHeights(t *testing.T) {
+	squares := []squareInfo{
+		{name: "a1", pieceHeight: 57},
+		{name: "a2", pieceHeight: 1.5},
+	}
+	test.That(t, squareHeights(squares), test.ShouldResemble, map[string]interface{}{"a1": 57.0, "a2": 1.5})
+}
+
+// problemSquare is a 60mm square of board 500mm from the camera with a pieceSize wide piece at x, y that's height tall
+func problemSquare(t *testing.T, x, y, pieceSize, height float64) pointcloud.PointCloud {
+	pc := pointcloud.NewBasicEmpty()
+	for px := 0.0; px <= 60; px += 2 {
+		for py := 0.0; py <= 60; py += 2 {
+			z := 500.0
+			if math.Abs(px-x) <= pieceSize/2 && math.Abs(py-y) <= pieceSize/2 {
+				z -= height
+			}
+			test.That(t, pc.Set(r3.Vector{px, py, z}, nil), test.ShouldBeNil)
+		}
+	}
+	return pc
+}
+
+func TestPieceProblem(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+	test.That(t, cfg.toppledHeight(), test.ShouldEqual, 30)
+	test.That(t, (&PieceFinderConfig{PieceHeights: map[string]float64{"P": 40, "K": 80}}).toppledHeight(), test.ShouldEqual, 24)
+
+	test.That(t, pieceProblem(problemSquare(t, 30, 30, 20, 0), 0, cfg), test.ShouldEqual, "")
+	test.That(t, pieceProblem(problemSquare(t, 30, 30, 20, 50), 50, cfg), test.ShouldEqual, "")
+	test.That(t, pieceProblem(problemSquare(t, 30, 30, 20, 20), 20, cfg), test.ShouldEqual, "toppled")
+
+	// knocked onto the edge, half of it is in the next square
+	test.That(t, pieceProblem(problemSquare(t, 60, 30, 20, 50), 50, cfg), test.ShouldEqual, "off-grid")
+	test.That(t, pieceProblem(problemSquare(t, 10, 50, 20, 50), 50, cfg), test.ShouldEqual, "off-grid")
+
+	test.That(t, pieceProblem(problemSquare(t, 30, 30, 20, 20), 20, &PieceFinderConfig{ToppledHeight: 18}), test.ShouldEqual, "")
+}
+
+func TestSquareProblems(t *testing.T) {
+	squares := []squareInfo{
+		{name: "a1"},
+		{name: "d4", problem: "toppled"},
+	}
+	test.That(t, squareProblems(squares), test.ShouldResemble, map[string]interface{}{"d4": "toppled"})
+}
+
+func TestSquareDetections(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 800, 800))
+	squares := []squareInfo{
+		{name: "e2", originalBounds: image.Rect(300, 100, 400, 200)},
+		{name: "e4", color: 1, confidence: 0.5, originalBounds: image.Rect(300, 300, 400, 400)},
+		{name: "d5", color: 2, originalBounds: image.Rect(400, 400, 500, 500)},
+	}
+
+	ds := squareDetections(img, squares)
+	test.That(t, len(ds), test.ShouldEqual, 2)
+	test.That(t, ds[0].Label(), test.ShouldEqual, "e4-W")
+	test.That(t, ds[0].Score(), test.ShouldEqual, 0.5)
+	test.That(t, *ds[0].BoundingBox(), test.ShouldResemble, image.Rect(300, 300, 400, 400))
+	test.That(t, ds[1].Label(), test.ShouldEqual, "d5-B")
+}
+
+func TestDebugImage(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cfg := &PieceFinderConfig{}
+	test.That(t, cfg.debugImage(now), test.ShouldEqual, "hack-test.jpg")
+
+	cfg.DebugImageDir = "/data/boards"
+	test.That(t, cfg.debugImage(now), test.ShouldEqual, "/data/boards/board-20240101-120000.000.jpg")
+}
+
+func TestBoardRect(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+	r, size, err := cfg.boardRect(image.Rect(0, 0, 640, 480))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, r, test.ShouldResemble, image.Rect(80, 0, 560, 480))
+	test.That(t, size, test.ShouldEqual, 60)
+
+	// portrait
+	r, _, err = cfg.boardRect(image.Rect(0, 0, 480, 640))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, r, test.ShouldResemble, image.Rect(0, 80, 480, 560))
+
+	_, _, err = cfg.boardRect(image.Rect(0, 0, 4, 4))
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// a 6x6 demo board
+	small := &PieceFinderConfig{Ranks: 6, Files: 6}
+	r, size, err = small.boardRect(image.Rect(0, 0, 640, 480))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, r, test.ShouldResemble, image.Rect(80, 0, 560, 480))
+	test.That(t, size, test.ShouldEqual, 80)
+
+	cfg.BoardBounds = []int{100, 20, 500, 430}
+	r, _, err = cfg.boardRect(image.Rect(0, 0, 640, 480))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, r, test.ShouldResemble, image.Rect(100, 20, 500, 420))
+
+	// a board-bounds for a bigger camera
+	_, _, err = cfg.boardRect(image.Rect(0, 0, 320, 240))
+	test.That(t, err.Error(), test.ShouldContainSubstring, "board-bounds")
+
+	cfg.Input = "cam"
+	_, _, err = cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	cfg.BoardBounds = []int{500, 20, 100, 430}
+	_, _, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestPieceFinderPortrait(t *testing.T) {
+	input := image.NewRGBA(image.Rect(0, 0, 480, 640))
+
+	out, squares, err := BoardDebugImageHack(input, pointcloud.NewBasicEmpty(), touch.RealSenseProperties, &PieceFinderConfig{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Bounds(), test.ShouldResemble, image.Rect(0, 0, 480, 480))
+	test.That(t, len(squares), test.ShouldEqual, 64)
+	for _, sq := range squares {
+		test.That(t, sq.originalBounds.In(input.Bounds()), test.ShouldBeTrue)
+		test.That(t, sq.originalBounds.Dx(), test.ShouldEqual, 60)
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	test.That(t, trimmedMean([]float64{10, 10, 10, 10}, 0.1), test.ShouldAlmostEqual, 10)
+
+	// one glare point out of ten doesn't count
+	values := []float64{40, 40, 40, 40, 40, 40, 40, 40, 40, 255}
+	test.That(t, trimmedMean(values, 0.1), test.ShouldAlmostEqual, 40)
+}
+
+func TestHSVMode(t *testing.T) {
+	cfg := &PieceFinderConfig{ColorMode: "hsv"}
+
+	maple := pieceCloudRGB(t, 225, 190, 140)
+	walnut := pieceCloudRGB(t, 100, 60, 35)
+
+	h, sat, val, ok := pieceHSV(maple, cfg)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, h, test.ShouldBeBetween, 20, 45)
+	test.That(t, sat, test.ShouldBeBetween, 0.3, 0.45)
+	test.That(t, val, test.ShouldBeBetween, 0.85, 0.9)
+
+	test.That(t, estimatePieceColor(maple, cfg), test.ShouldEqual, 1)
+	test.That(t, estimatePieceColor(walnut, cfg), test.ShouldEqual, 2)
+
+	cfg.Input = "cam"
+	cfg.ColorMode = "lab"
+	_, _, err := cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestEmptyBaseline(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+
+	empty := pointcloud.NewBasicEmpty()
+	covered := pointcloud.NewBasicEmpty()
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			test.That(t, empty.Set(r3.Vector{float64(x), float64(y), 500}, nil), test.ShouldBeNil)
+			// a wide piece filling the whole square, no board to see
+			test.That(t, covered.Set(r3.Vector{float64(x), float64(y), 450}, nil), test.ShouldBeNil)
+		}
+	}
+
+	test.That(t, heightAboveBaseline(covered, "e4", cfg), test.ShouldAlmostEqual, 0)
+
+	baseline, err := emptyBaseline([]squareInfo{{name: "e4", pc: empty}}, cfg)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, baseline["e4"], test.ShouldAlmostEqual, 500)
+
+	cfg.EmptyBaseline = baseline
+	test.That(t, heightAboveBaseline(covered, "e4", cfg), test.ShouldAlmostEqual, 50)
+	test.That(t, heightAboveBaseline(empty, "e4", cfg), test.ShouldAlmostEqual, 0)
+
+	_, err = emptyBaseline([]squareInfo{{name: "d4", pc: pieceCloud(t, 200)}}, cfg)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "d4")
+}
+
+func TestSquareConfidence(t *testing.T) {
+	cfg := &PieceFinderConfig{}
+
+	test.That(t, squareConfidence(pointcloud.NewBasicEmpty(), 0, 0, cfg), test.ShouldAlmostEqual, 1)
+	test.That(t, squareConfidence(pointcloud.NewBasicEmpty(), 14, 0, cfg), test.ShouldBeLessThan, 0.1)
+
+	sure := squareConfidence(pieceCloud(t, 250), 50, 1, cfg)
+	unsure := squareConfidence(pieceCloud(t, 135), 50, 1, cfg)
+	test.That(t, sure, test.ShouldBeGreaterThan, unsure)
+	test.That(t, unsure, test.ShouldBeLessThan, 0.2)
+}
+
+func TestSplitConfidence(t *testing.T) {
+	label, confidence := splitConfidence("e4-1-Q@0.87")
+	test.That(t, label, test.ShouldEqual, "e4-1-Q")
+	test.That(t, confidence, test.ShouldAlmostEqual, 0.87)
+
+	label, confidence = splitConfidence("e4-0")
+	test.That(t, label, test.ShouldEqual, "e4-0")
+	test.That(t, confidence, test.ShouldEqual, 1)
+}
+
+func TestSmallBoard(t *testing.T) {
+	input := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	cfg := &PieceFinderConfig{Ranks: 6, Files: 5}
+
+	_, squares, err := BoardDebugImageHack(input, pointcloud.NewBasicEmpty(), touch.RealSenseProperties, cfg)
 	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(squares), test.ShouldEqual, 30)
+	test.That(t, squares[len(squares)-1].name, test.ShouldEqual, "e6")
+	test.That(t, boardFEN(squares), test.ShouldEqual, "5/5/5/5/5/5")
 
-	err = rimage.WriteImageToFile("hack-test.jpg", out)
+	cfg.Input = "cam"
+	cfg.BoardBounds = []int{0, 0, 5, 6}
+	_, _, err = cfg.Validate("")
 	test.That(t, err, test.ShouldBeNil)
+	cfg.BoardBounds = []int{0, 0, 4, 6}
+	_, _, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	err = checkBoardSize("pf", &PieceFinder{conf: cfg})
+	test.That(t, err, test.ShouldNotBeNil)
+	err = checkBoardSize("pf", &PieceFinder{conf: &PieceFinderConfig{}})
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestDecodeImageBackoff(t *testing.T) {
+	bc := &PieceFinder{conf: &PieceFinderConfig{ImageRetries: 2}, logger: logging.NewTestLogger(t)}
+	bad, err := camera.NamedImageFromBytes([]byte("not a jpeg"), "color", utils.MimeTypeJPEG, data.Annotations{})
+	test.That(t, err, test.ShouldBeNil)
+
+	start := time.Now()
+	_, err = bc.decodeImage(context.Background(), []camera.NamedImage{bad})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, time.Since(start), test.ShouldBeGreaterThanOrEqualTo, 3*imageRetryBackoff)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bc.decodeImage(ctx, []camera.NamedImage{bad})
+	test.That(t, err, test.ShouldEqual, context.Canceled)
 }
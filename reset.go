@@ -11,6 +11,7 @@ var homeRanks = []chess.Rank{chess.Rank1, chess.Rank2, chess.Rank7, chess.Rank8}
 type resetState struct {
 	board     *chess.Board
 	graveyard []int
+	correct   *chess.Board // where we're resetting to, nil for the standard starting position
 }
 
 func (s *resetState) applyMove(from, to chess.Square) error {
@@ -34,6 +35,13 @@ func squareToString(s chess.Square) string {
 	return s.String()
 }
 
+func parseSquare(s string) (chess.Square, error) {
+	if len(s) != 2 || s[0] < 'a' || s[0] > 'h' || s[1] < '1' || s[1] > '8' {
+		return chess.NoSquare, fmt.Errorf("bad square [%s]", s)
+	}
+	return chess.NewSquare(chess.File(s[0]-'a'), chess.Rank(s[1]-'1')), nil
+}
+
 func findForRest(theState *resetState, correct *chess.Board, what chess.Piece) (chess.Square, error) {
 	for _, r := range []chess.Rank{
 		chess.Rank1, chess.Rank2, chess.Rank7, chess.Rank8,
@@ -65,7 +73,10 @@ func findForRest(theState *resetState, correct *chess.Board, what chess.Piece) (
 func nextResetMove(theState *resetState) (chess.Square, chess.Square, error) {
 	// first look for empty home squares
 
-	correct := chess.NewGame().Position().Board()
+	correct := theState.correct
+	if correct == nil {
+		correct = chess.NewGame().Position().Board()
+	}
 
 	for _, r := range homeRanks {
 		for f := chess.FileA; f <= chess.FileH; f++ {
@@ -74,7 +85,7 @@ func nextResetMove(theState *resetState) (chess.Square, chess.Square, error) {
 			have := theState.board.Piece(sq)
 			good := correct.Piece(sq)
 
-			if have == chess.NoPiece {
+			if have == chess.NoPiece && good != chess.NoPiece {
 				from, err := findForRest(theState, correct, good)
 				if err != nil {
 					return chess.A1, chess.A1, err
@@ -5,15 +5,17 @@ import (
 	"testing"
 
 	"go.viam.com/test"
+
+	"github.com/corentings/chess/v2"
 )
 
 func TestReset1(t *testing.T) {
 	ctx := context.Background()
 
-	theMainState, err := readState(ctx, "data/reset1.json")
+	theMainState, err := readState(ctx, "data/reset1.json", "")
 	test.That(t, err, test.ShouldBeNil)
 
-	theState := &resetState{theMainState.game.Position().Board(), theMainState.graveyard}
+	theState := &resetState{board: theMainState.game.Position().Board(), graveyard: theMainState.graveyard}
 
 	from, to, err := nextResetMove(theState)
 	test.That(t, err, test.ShouldBeNil)
@@ -24,10 +26,10 @@ func TestReset1(t *testing.T) {
 func TestReset2(t *testing.T) {
 	ctx := context.Background()
 
-	theMainState, err := readState(ctx, "data/reset2.json")
+	theMainState, err := readState(ctx, "data/reset2.json", "")
 	test.That(t, err, test.ShouldBeNil)
 
-	theState := &resetState{theMainState.game.Position().Board(), theMainState.graveyard}
+	theState := &resetState{board: theMainState.game.Position().Board(), graveyard: theMainState.graveyard}
 
 	// -
 
@@ -87,3 +89,31 @@ func TestReset2(t *testing.T) {
 	test.That(t, to, test.ShouldEqual, -1)
 
 }
+
+func TestResetHandicap(t *testing.T) {
+	ctx := context.Background()
+
+	// white plays without a queen
+	startFEN := "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNB1KBNR w KQkq - 0 1"
+
+	start, err := newGame(startFEN)
+	test.That(t, err, test.ShouldBeNil)
+
+	theMainState, err := readState(ctx, "data/does-not-exist.json", startFEN)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, theMainState.game.FEN(), test.ShouldEqual, startFEN)
+
+	theState := &resetState{
+		board:     theMainState.game.Position().Board(),
+		graveyard: theMainState.graveyard,
+		correct:   start.Position().Board(),
+	}
+
+	from, to, err := nextResetMove(theState)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, from, test.ShouldEqual, -1)
+	test.That(t, to, test.ShouldEqual, -1)
+
+	test.That(t, checkMaterial(theState.board, start.Position().Board()), test.ShouldBeNil)
+	test.That(t, checkMaterial(chess.NewGame().Position().Board(), start.Position().Board()), test.ShouldNotBeNil)
+}